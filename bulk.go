@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/google/uuid"
+	"google.golang.org/api/sheets/v4"
+)
+
+// The most objects one bulk request can add, or delete by ID
+const MAX_BULK_OBJECTS = 10000
+
+/*
+How many rows go in each AppendCellsRequest. Every chunk is its own BatchUpdate, so it costs one write request against
+the quota, and a failed chunk doesn't undo the ones before it.
+*/
+const BULK_APPEND_CHUNK_SIZE = 500
+
+type AddObjectsToSheetRequest struct {
+	SpreadsheetTitle string
+	SheetTitle       string
+	// Each one in either of the formats addObjectToSheet's NewObject takes
+	NewObjects []json.RawMessage
+}
+
+// What happened to one of the objects in a bulk request, in the same order as the request
+type BulkObjectResult struct {
+	Index int
+	// The status the object would have had on its own, 201 if it was added
+	Status   int
+	ObjectId string        `json:",omitempty"`
+	Error    *ErrorDetails `json:",omitempty"`
+}
+
+/*
+Adds many objects to a sheet with a handful of Sheets calls: one to look the sheet up (none if it's cached) and one
+BatchUpdate per BULK_APPEND_CHUNK_SIZE objects. Objects that are invalid or break the schema are reported and skipped,
+and the rest are still added. Chunks are appended in order and the first chunk that fails stops the rest, so the
+objects that were added are always the valid ones before some point in the request.
+*/
+func addObjectsToSheet(w http.ResponseWriter, r *http.Request) {
+	requestBody := new(AddObjectsToSheetRequest)
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Unable to unmarshal request body JSON. Error: "+err.Error())
+		return
+	}
+
+	var spreadsheetTitle string = requestBody.SpreadsheetTitle
+	var sheetTitle string = requestBody.SheetTitle
+
+	if len(requestBody.NewObjects) == 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "NewObjects must have at least one object")
+		return
+	}
+	if len(requestBody.NewObjects) > MAX_BULK_OBJECTS {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", fmt.Sprintf("NewObjects can have at most %d objects", MAX_BULK_OBJECTS))
+		return
+	}
+
+	spreadsheetId, err := getSpreadsheetId(r.Context(), spreadsheetTitle)
+	if err != nil {
+		writeSpreadsheetLookupError(w, r, spreadsheetTitle, err)
+		return
+	}
+	cached, _, err := sheetStructureCache.get(r.Context(), spreadsheetId, sheetTitle)
+	if err != nil {
+		writeSheetReadError(w, r, spreadsheetTitle, sheetTitle, err)
+		return
+	}
+	sheet := cached.sheet
+	sheetId := sheet.Properties.SheetId
+
+	columnHeaders := getColumnHeaders(sheet)
+	schema, err := getSheetSchema(sheet)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "invalid_schema", err.Error())
+		return
+	}
+
+	// Every object in the request gets the same timestamp
+	timestamp := newObjectTimestamp()
+	results := make([]BulkObjectResult, len(requestBody.NewObjects))
+	var validIndexes []int
+	var validRows []*sheets.RowData
+
+	for index, rawObject := range requestBody.NewObjects {
+		results[index].Index = index
+		objectId := uuid.New().String()
+		newObjectRow, objectErr := newObjectRowData(columnHeaders, schema, objectId, timestamp, rawObject)
+		if objectErr != nil {
+			objectErr.details.RequestID = getRequestId(r)
+			results[index].Status = objectErr.status
+			results[index].Error = &objectErr.details
+			continue
+		}
+		results[index].ObjectId = objectId
+		validIndexes = append(validIndexes, index)
+		validRows = append(validRows, newObjectRow)
+	}
+
+	addedCount := 0
+	var appendErr error
+	for chunkStart := 0; chunkStart < len(validRows); chunkStart += BULK_APPEND_CHUNK_SIZE {
+		chunkEnd := min(chunkStart+BULK_APPEND_CHUNK_SIZE, len(validRows))
+		chunkIndexes := validIndexes[chunkStart:chunkEnd]
+
+		if appendErr != nil {
+			for _, index := range chunkIndexes {
+				results[index].ObjectId = ""
+				results[index].Status = http.StatusFailedDependency
+				results[index].Error = &ErrorDetails{Code: "not_attempted", Message: "Not added because an earlier chunk of objects failed", RequestID: getRequestId(r)}
+			}
+			continue
+		}
+
+		var chunkObjectIds []string
+		for _, index := range chunkIndexes {
+			chunkObjectIds = append(chunkObjectIds, results[index].ObjectId)
+		}
+
+		appendErr = appendObjectsWithRetries(r.Context(), spreadsheetId, sheetTitle, chunkObjectIds,
+			[]*sheets.Request{
+				{
+					AppendCells: &sheets.AppendCellsRequest{
+						Fields:  "*",
+						Rows:    validRows[chunkStart:chunkEnd],
+						SheetId: sheetId,
+					},
+				},
+			},
+		)
+
+		if appendErr != nil {
+			// Nothing has been added yet, so this is the same failure a single add would have had
+			if addedCount == 0 && len(validRows) == len(requestBody.NewObjects) {
+				writeGoogleError(w, r, appendErr, "Error while trying to add objects to sheet")
+				return
+			}
+			status, details := googleErrorDetails(r, appendErr, "Error while trying to add objects to sheet")
+			details.RequestID = getRequestId(r)
+			for _, index := range chunkIndexes {
+				results[index].ObjectId = ""
+				results[index].Status = status
+				results[index].Error = &details
+			}
+			continue
+		}
+
+		for _, index := range chunkIndexes {
+			results[index].Status = http.StatusCreated
+		}
+		addedCount += len(chunkIndexes)
+	}
+
+	var responseBody map[string]any = make(map[string]any)
+	responseBody["Added"] = addedCount
+	responseBody["Failed"] = len(results) - addedCount
+	responseBody["Results"] = results
+	responseBody["SheetUrl"] = buildSpreadsheetUrl(spreadsheetId, sheetId)
+
+	// 207 tells the client to look at each object's result, because some (or all) of them weren't added
+	status := http.StatusCreated
+	if addedCount < len(results) {
+		status = http.StatusMultiStatus
+	}
+	writeJSON(w, r, status, responseBody)
+}
+
+type DeleteObjectsRequest struct {
+	SpreadsheetTitle string
+	SheetTitle       string
+	// Either the IDs of the objects to delete, or a filter expression that matches them, not both
+	ObjectIds []string
+	Filter    string
+}
+
+/*
+Deletes many objects with one read and one write. The rows to delete are all found in the same read of the sheet, and
+deleted with a single BatchUpdate whose ranges go from the bottom of the sheet up, so that deleting one range doesn't
+move the rows of the ranges after it.
+*/
+func deleteObjects(w http.ResponseWriter, r *http.Request) {
+	requestBody := new(DeleteObjectsRequest)
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Unable to unmarshal request body JSON. Error: "+err.Error())
+		return
+	}
+
+	var spreadsheetTitle string = requestBody.SpreadsheetTitle
+	var sheetTitle string = requestBody.SheetTitle
+
+	if (len(requestBody.ObjectIds) == 0) == (requestBody.Filter == "") {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Either ObjectIds or Filter is required, but not both")
+		return
+	}
+	if len(requestBody.ObjectIds) > MAX_BULK_OBJECTS {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", fmt.Sprintf("ObjectIds can have at most %d IDs", MAX_BULK_OBJECTS))
+		return
+	}
+
+	spreadsheetId, err := getSpreadsheetId(r.Context(), spreadsheetTitle)
+	if err != nil {
+		writeSpreadsheetLookupError(w, r, spreadsheetTitle, err)
+		return
+	}
+
+	// Deleting by ID only needs the id column, a filter needs every row. Either way the sheet is read fresh rather than
+	// through the cache, because the row indexes are used without checking each row again.
+	unlock := rowIndexLocks.lock(spreadsheetId)
+	defer unlock()
+	var sheet *sheets.Sheet
+	var rows []*sheets.RowData
+	if requestBody.Filter == "" {
+		sheet, err = getSheetHeaderAndIds(r.Context(), spreadsheetId, sheetTitle)
+		if err == nil {
+			rows = sheet.Data[1].RowData
+		}
+	} else {
+		sheet, err = getSheetWithRows(r.Context(), spreadsheetId, sheetTitle)
+		if err == nil {
+			rows = sheet.Data[0].RowData
+		}
+	}
+	if err != nil {
+		writeSheetReadError(w, r, spreadsheetTitle, sheetTitle, err)
+		return
+	}
+	sheetId := sheet.Properties.SheetId
+
+	var rowIndexesToDelete []int64
+	var notFoundObjectIds []string = make([]string, 0)
+
+	if requestBody.Filter == "" {
+		rowIndexes := make(map[string]int64)
+		for index := len(rows) - 1; index > 0; index-- {
+			// Going up the sheet, so that if an id is in it twice the first one wins, the same as every other lookup
+			if objectId := cellFormattedValue(rows[index], 0); objectId != "" {
+				rowIndexes[objectId] = int64(index)
+			}
+		}
+		for _, objectId := range requestBody.ObjectIds {
+			rowIndex, found := rowIndexes[objectId]
+			if !found {
+				if !slices.Contains(notFoundObjectIds, objectId) {
+					notFoundObjectIds = append(notFoundObjectIds, objectId)
+				}
+				continue
+			}
+			rowIndexesToDelete = append(rowIndexesToDelete, rowIndex)
+		}
+	} else {
+		columnHeaders := getColumnHeaders(&sheets.Sheet{Data: sheet.Data[:1]})
+		filter, err := parseFilter(requestBody.Filter, columnHeaders)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_filter", err.Error())
+			return
+		}
+		for index := 1; index < len(rows); index++ {
+			// Blank rows aren't objects, so a filter can't delete them
+			if cellFormattedValue(rows[index], 0) != "" && filter.matches(rowToObject(columnHeaders, rows[index])) {
+				rowIndexesToDelete = append(rowIndexesToDelete, int64(index))
+			}
+		}
+	}
+
+	rowIndexesToDelete = slices.Compact(slices.Sorted(slices.Values(rowIndexesToDelete)))
+	var deletedObjectIds []string = make([]string, 0)
+	for _, rowIndex := range rowIndexesToDelete {
+		deletedObjectIds = append(deletedObjectIds, cellFormattedValue(rows[rowIndex], 0))
+	}
+
+	if len(rowIndexesToDelete) > 0 {
+		err = batchUpdateObjects(r.Context(), spreadsheetId, deleteRowRangeRequests(sheetId, rowIndexesToDelete))
+		if err != nil {
+			writeMutationError(w, r, err, "Error while trying to delete objects from sheet")
+			return
+		}
+		sheetStructureCache.rowsDeleted(spreadsheetId, sheetTitle, rowIndexesToDelete...)
+	}
+
+	var responseBody map[string]any = make(map[string]any)
+
+	responseBody["DeletedObjectIds"] = deletedObjectIds
+	responseBody["NotFoundObjectIds"] = notFoundObjectIds
+	responseBody["SheetUrl"] = buildSpreadsheetUrl(spreadsheetId, sheetId)
+
+	writeJSON(w, r, http.StatusOK, responseBody)
+}
+
+/*
+Builds a DeleteRange for every run of consecutive rows in the sorted row indexes, ordered from the bottom of the sheet
+up. Sheets applies the requests in a BatchUpdate in order, so deleting the lowest rows first leaves the indexes of the
+rows above them where they were.
+*/
+func deleteRowRangeRequests(sheetId int64, sortedRowIndexes []int64) []*sheets.Request {
+	var requests []*sheets.Request
+	for end := len(sortedRowIndexes); end > 0; {
+		start := end - 1
+		for start > 0 && sortedRowIndexes[start-1] == sortedRowIndexes[start]-1 {
+			start--
+		}
+		requests = append(requests, &sheets.Request{
+			DeleteRange: &sheets.DeleteRangeRequest{
+				Range: &sheets.GridRange{
+					StartRowIndex: sortedRowIndexes[start],
+					EndRowIndex:   sortedRowIndexes[end-1] + 1,
+					SheetId:       sheetId,
+				},
+				ShiftDimension: "ROWS",
+			},
+		})
+		end = start
+	}
+	return requests
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeleteRowRangeRequests(t *testing.T) {
+	const sheetId = 7
+
+	tests := []struct {
+		name             string
+		sortedRowIndexes []int64
+		// Each range as start and end row index, in the order they should be sent
+		want [][2]int64
+	}{
+		{
+			name:             "none",
+			sortedRowIndexes: nil,
+			want:             nil,
+		},
+		{
+			name:             "one row",
+			sortedRowIndexes: []int64{4},
+			want:             [][2]int64{{4, 5}},
+		},
+		{
+			name:             "consecutive rows are one range",
+			sortedRowIndexes: []int64{2, 3, 4},
+			want:             [][2]int64{{2, 5}},
+		},
+		{
+			name:             "separate rows go bottom up",
+			sortedRowIndexes: []int64{1, 3, 5},
+			want:             [][2]int64{{5, 6}, {3, 4}, {1, 2}},
+		},
+		{
+			name:             "runs are merged and go bottom up",
+			sortedRowIndexes: []int64{1, 2, 5, 6, 7, 10},
+			want:             [][2]int64{{10, 11}, {5, 8}, {1, 3}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := deleteRowRangeRequests(sheetId, test.sortedRowIndexes)
+			if len(requests) != len(test.want) {
+				t.Fatalf("got %d requests, want %d", len(requests), len(test.want))
+			}
+			for index, request := range requests {
+				deleteRange := request.DeleteRange
+				if deleteRange == nil || deleteRange.Range == nil {
+					t.Fatalf("request %d isn't a DeleteRange", index)
+				}
+				got := [2]int64{deleteRange.Range.StartRowIndex, deleteRange.Range.EndRowIndex}
+				if got != test.want[index] {
+					t.Errorf("request %d deletes rows %v, want %v", index, got, test.want[index])
+				}
+				if deleteRange.Range.SheetId != sheetId || deleteRange.ShiftDimension != "ROWS" {
+					t.Errorf("request %d has sheet %d and shift %q", index, deleteRange.Range.SheetId, deleteRange.ShiftDimension)
+				}
+				if err := checkObjectMutation(request); err != nil {
+					t.Errorf("request %d is refused by checkObjectMutation: %v", index, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteObjectsConcurrently(t *testing.T) {
+	fake := newFakeSheets(t, [][]string{{"id", "datetime"}, {"a"}, {"b"}, {"c"}, {"d"}, {"e"}})
+	// Holding up the first delete gives the second one time to read the rows, which it mustn't do until the first is done
+	var holdUpFirst sync.Once
+	fake.beforeBatchUpdate = func() { holdUpFirst.Do(func() { time.Sleep(100 * time.Millisecond) }) }
+
+	previousRegistry, previousCache := spreadsheetRegistry, sheetStructureCache
+	spreadsheetRegistry = newJsonFileRegistry(filepath.Join(t.TempDir(), "spreadsheetIDs.json"), 0600)
+	sheetStructureCache = newSheetCache(time.Minute)
+	t.Cleanup(func() { spreadsheetRegistry, sheetStructureCache = previousRegistry, previousCache })
+	if err := spreadsheetRegistry.Register("Fake", "spreadsheet"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wait sync.WaitGroup
+	for _, objectId := range []string{"b", "c"} {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			body := `{"SpreadsheetTitle": "Fake", "SheetTitle": "` + FAKE_SHEET_TITLE + `", "ObjectIds": ["` + objectId + `"]}`
+			recorder := httptest.NewRecorder()
+			deleteObjects(recorder, httptest.NewRequest(http.MethodPost, "/deleteObjects", strings.NewReader(body)))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("deleting %s responded %d: %s", objectId, recorder.Code, recorder.Body)
+			}
+		}()
+		// Started in order, so that b's delete is the one that's held up
+		time.Sleep(10 * time.Millisecond)
+	}
+	wait.Wait()
+
+	if ids, want := fake.ids(), []string{"id", "a", "d", "e"}; !slices.Equal(ids, want) {
+		t.Errorf("ids left = %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+/*
+What we know about one sheet without reading it again: its properties, its header row (column headers and schema) and
+which row every object is in. An entry is never changed once it's in the cache, our own writes replace it with an
+updated copy instead, so it can be used without holding the cache's lock.
+*/
+type cachedSheet struct {
+	// The sheet's properties, with the header row as Data[0]
+	sheet *sheets.Sheet
+	// The id column, indexed by row. ids[0] is the "id" column header.
+	ids        []string
+	rowIndexes map[string]int64
+	// The spreadsheet's Drive version when this was read
+	version  int64
+	loadedAt time.Time
+}
+
+// Returns the object's row index, and whether it's in the sheet at all
+func (cached *cachedSheet) rowIndex(objectId string) (int64, bool) {
+	rowIndex, found := cached.rowIndexes[objectId]
+	return rowIndex, found
+}
+
+func newCachedSheet(sheet *sheets.Sheet, version int64) *cachedSheet {
+	cached := &cachedSheet{
+		sheet:    &sheets.Sheet{Properties: sheet.Properties, Data: sheet.Data[:1]},
+		version:  version,
+		loadedAt: time.Now(),
+	}
+	for _, row := range sheet.Data[1].RowData {
+		cached.ids = append(cached.ids, cellFormattedValue(row, 0))
+	}
+	cached.indexIds()
+	return cached
+}
+
+func (cached *cachedSheet) indexIds() {
+	cached.rowIndexes = make(map[string]int64)
+	for index, objectId := range cached.ids {
+		// Row 0 is the header and blank rows have no id, neither can be looked up. If an id is somehow in the sheet
+		// twice, the first one wins, the same as reading down the column.
+		if _, ok := cached.rowIndexes[objectId]; index > 0 && objectId != "" && !ok {
+			cached.rowIndexes[objectId] = int64(index)
+		}
+	}
+}
+
+type sheetCacheKey struct {
+	spreadsheetId string
+	sheetTitle    string
+}
+
+/*
+Caches each sheet's structure and id column, so that finding a sheet's ID, headers or schema, or finding an object's
+row, doesn't cost a read of the sheet on every request. Our own writes keep the cache up to date. Changes made by anyone
+else are picked up after the TTL, when the spreadsheet's Drive version is checked and the sheet is read again if it has
+changed. Rows found through the cache are always checked to still have the right id before they're used, so a stale
+cache can only cost an extra read, never the wrong row.
+*/
+type sheetCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[sheetCacheKey]*cachedSheet
+	// Bumped by every write and invalidation, so that a read that started before it isn't cached over the top of it
+	generations map[sheetCacheKey]int64
+}
+
+var sheetStructureCache *sheetCache
+
+func newSheetCache(ttl time.Duration) *sheetCache {
+	return &sheetCache{ttl: ttl, entries: make(map[sheetCacheKey]*cachedSheet), generations: make(map[sheetCacheKey]int64)}
+}
+
+/*
+Returns the sheet's cached structure, reading it from Sheets if it isn't cached or has changed since. The bool is true
+when it was just read, so callers know there's no point reading it again. Returns ErrSheetNotFound if the spreadsheet
+has no sheet with the title.
+*/
+func (cache *sheetCache) get(ctx context.Context, spreadsheetId string, sheetTitle string) (*cachedSheet, bool, error) {
+	key := sheetCacheKey{spreadsheetId, sheetTitle}
+
+	cache.mu.Lock()
+	cached := cache.entries[key]
+	generation := cache.generations[key]
+	cache.mu.Unlock()
+
+	if cached != nil && time.Since(cached.loadedAt) < cache.ttl {
+		return cached, false, nil
+	}
+
+	// Past the TTL, the Drive version says whether anything in the spreadsheet has changed since it was read
+	var version int64
+	var err error
+	if cache.ttl > 0 {
+		version, err = getSpreadsheetVersion(ctx, spreadsheetId)
+		if err != nil {
+			// The sheet can still be read without it, it just won't be trusted past the TTL next time
+			log.Printf("Unable to get the Drive version of spreadsheet %s: %v", spreadsheetId, err)
+		}
+	}
+	if cached != nil && err == nil && version == cached.version {
+		refreshed := *cached
+		refreshed.loadedAt = time.Now()
+		cache.store(key, generation, &refreshed)
+		return &refreshed, false, nil
+	}
+
+	sheet, err := getSheetHeaderAndIds(ctx, spreadsheetId, sheetTitle)
+	if err != nil {
+		return nil, false, err
+	}
+	cached = newCachedSheet(sheet, version)
+	cache.store(key, generation, cached)
+	return cached, true, nil
+}
+
+func (cache *sheetCache) store(key sheetCacheKey, generation int64, cached *cachedSheet) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.ttl > 0 && cache.generations[key] == generation {
+		cache.entries[key] = cached
+	}
+}
+
+// Drops the sheet from the cache, so the next request reads it again
+func (cache *sheetCache) invalidate(spreadsheetId string, sheetTitle string) {
+	key := sheetCacheKey{spreadsheetId, sheetTitle}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	delete(cache.entries, key)
+	cache.generations[key]++
+}
+
+// Applies one of our own writes to the cached sheet, if it's cached
+func (cache *sheetCache) update(spreadsheetId string, sheetTitle string, apply func(updated *cachedSheet)) {
+	key := sheetCacheKey{spreadsheetId, sheetTitle}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.generations[key]++
+	cached := cache.entries[key]
+	if cached == nil {
+		return
+	}
+
+	updated := *cached
+	updated.ids = slices.Clone(cached.ids)
+	apply(&updated)
+	updated.indexIds()
+	cache.entries[key] = &updated
+}
+
+/*
+Records objects appended to the sheet, in order. Sheets appends after the last row with anything in it, which is the row
+after the last id unless someone has written below the data, and if so the row check catches it.
+*/
+func (cache *sheetCache) objectsAppended(spreadsheetId string, sheetTitle string, objectIds ...string) {
+	cache.update(spreadsheetId, sheetTitle, func(updated *cachedSheet) {
+		updated.ids = append(updated.ids, objectIds...)
+	})
+}
+
+// Records deleted rows, given by their indexes from before any of them were deleted. Each moves every row below it up one.
+func (cache *sheetCache) rowsDeleted(spreadsheetId string, sheetTitle string, rowIndexes ...int64) {
+	cache.update(spreadsheetId, sheetTitle, func(updated *cachedSheet) {
+		// Bottom up, so deleting one row doesn't move the ones still to be deleted
+		sortedIndexes := slices.Compact(slices.Sorted(slices.Values(rowIndexes)))
+		for _, rowIndex := range slices.Backward(sortedIndexes) {
+			if rowIndex > 0 && rowIndex < int64(len(updated.ids)) {
+				updated.ids = slices.Delete(updated.ids, int(rowIndex), int(rowIndex)+1)
+			}
+		}
+	})
+}
+
+func getSpreadsheetVersion(ctx context.Context, spreadsheetId string) (int64, error) {
+	file, err := driveService.Files.Get(spreadsheetId).Fields("version").Context(ctx).Do()
+	if err != nil {
+		return 0, err
+	}
+	return file.Version, nil
+}
+
+/*
+Finds the object's row through the cache and reads it. If the row that comes back doesn't have the object's id, or the
+object isn't in a cached sheet, the sheet has changed since it was cached, so it's read again and looked up once more.
+The bool is false if the object isn't in the sheet, and then the row index and row mean nothing.
+*/
+func readObjectRow(ctx context.Context, spreadsheetId string, sheetTitle string, objectId string) (*cachedSheet, int64, *sheets.RowData, bool, error) {
+	for attempt := 1; ; attempt++ {
+		cached, justRead, err := sheetStructureCache.get(ctx, spreadsheetId, sheetTitle)
+		if err != nil {
+			return nil, 0, nil, false, err
+		}
+		lastAttempt := justRead || attempt == 2
+
+		rowIndex, found := cached.rowIndex(objectId)
+		if !found && lastAttempt {
+			return cached, 0, nil, false, nil
+		}
+
+		if found {
+			row, err := getSheetRow(ctx, spreadsheetId, sheetTitle, rowIndex)
+			if err != nil {
+				return nil, 0, nil, false, err
+			}
+			if cellFormattedValue(row, 0) == objectId {
+				return cached, rowIndex, row, true, nil
+			}
+			if lastAttempt {
+				// Changed again between reading the id column and reading the row
+				return cached, 0, nil, false, nil
+			}
+		}
+
+		sheetStructureCache.invalidate(spreadsheetId, sheetTitle)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Sheets stores dates as the number of days since this date
+var sheetsEpoch = time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+
+// Date cells get written with these patterns so that they show in the sheet the same way they're read back
+const DATE_PATTERN = "yyyy-mm-dd"
+const DATE_TIME_PATTERN = `yyyy-mm-dd"T"hh:mm:ss`
+
+/*
+Datetimes are read back in this layout, which is RFC3339 without the offset, because cells don't keep one. It's also
+accepted when writing, so that a datetime that was read can be written back as it is.
+*/
+const DATE_TIME_LAYOUT = "2006-01-02T15:04:05"
+
+/*
+Builds the cell for a value from a request body, based on its JSON type:
+  - numbers and booleans are stored as numbers and booleans, so Sheets can sort and SUM them
+  - strings starting with "=" are stored as formulas
+  - ISO dates ("2006-01-02") and RFC3339 datetimes, with or without an offset, are stored as date-formatted numbers
+  - any other string is stored as text, and null is left blank
+
+Values must be decoded with json.Decoder.UseNumber so that numbers come through as json.Number.
+*/
+func newCellData(value any) (*sheets.CellData, error) {
+	switch typedValue := value.(type) {
+	case nil:
+		return &sheets.CellData{}, nil
+
+	case bool:
+		return &sheets.CellData{UserEnteredValue: &sheets.ExtendedValue{BoolValue: &typedValue}}, nil
+
+	case json.Number:
+		numberValue, err := typedValue.Float64()
+		if err != nil {
+			return nil, errors.New("number " + typedValue.String() + " is out of range")
+		}
+		return &sheets.CellData{UserEnteredValue: &sheets.ExtendedValue{NumberValue: &numberValue}}, nil
+
+	case string:
+		if strings.HasPrefix(typedValue, "=") {
+			return &sheets.CellData{UserEnteredValue: &sheets.ExtendedValue{FormulaValue: &typedValue}}, nil
+		}
+		if date, err := time.Parse(time.DateOnly, typedValue); err == nil {
+			return newDateCellData(date, "DATE", DATE_PATTERN), nil
+		}
+		if datetime, ok := parseDatetime(typedValue); ok {
+			return newDateCellData(datetime, "DATE_TIME", DATE_TIME_PATTERN), nil
+		}
+		return newStringCellData(typedValue), nil
+
+	default:
+		return nil, errors.New("must be a string, number, boolean or null")
+	}
+}
+
+func newStringCellData(value string) *sheets.CellData {
+	return &sheets.CellData{UserEnteredValue: &sheets.ExtendedValue{StringValue: &value}}
+}
+
+func newDateCellData(date time.Time, numberFormatType string, pattern string) *sheets.CellData {
+	serialDate := toSheetsSerialDate(date)
+	return &sheets.CellData{
+		UserEnteredValue:  &sheets.ExtendedValue{NumberValue: &serialDate},
+		UserEnteredFormat: &sheets.CellFormat{NumberFormat: &sheets.NumberFormat{Type: numberFormatType, Pattern: pattern}},
+	}
+}
+
+// Parses an RFC3339 datetime, or one in DATE_TIME_LAYOUT as datetimes are read back
+func parseDatetime(value string) (time.Time, bool) {
+	if datetime, err := time.Parse(time.RFC3339, value); err == nil {
+		return datetime, true
+	}
+	if datetime, err := time.Parse(DATE_TIME_LAYOUT, value); err == nil {
+		return datetime, true
+	}
+	return time.Time{}, false
+}
+
+/*
+Sheets cells have no timezone (the whole spreadsheet has one), so the date is stored with the same clock time that was
+sent rather than being converted to UTC.
+*/
+func toSheetsSerialDate(date time.Time) float64 {
+	wallClockDate := time.Date(date.Year(), date.Month(), date.Day(), date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), time.UTC)
+	seconds := wallClockDate.Unix() - sheetsEpoch.Unix()
+	return (float64(seconds) + float64(wallClockDate.Nanosecond())/1e9) / (24 * 60 * 60)
+}
+
+// The other way round from toSheetsSerialDate, to the nearest second, in UTC standing in for the spreadsheet's timezone
+func fromSheetsSerialDate(serialDate float64) time.Time {
+	return sheetsEpoch.Add(time.Duration(math.Round(serialDate*24*60*60)) * time.Second)
+}
+
+/*
+Turns a cell that was read with grid data into a typed JSON value. Dates come back as "2006-01-02" and datetimes in
+DATE_TIME_LAYOUT whatever pattern the cell is shown with, times as their formatted value, formulas as whatever they
+evaluate to, and blank cells as "".
+*/
+func cellToValue(cell *sheets.CellData) any {
+	if cell == nil || cell.EffectiveValue == nil {
+		return ""
+	}
+
+	if cell.EffectiveFormat != nil && cell.EffectiveFormat.NumberFormat != nil {
+		numberValue := cell.EffectiveValue.NumberValue
+		switch cell.EffectiveFormat.NumberFormat.Type {
+		case "DATE":
+			if numberValue != nil {
+				return fromSheetsSerialDate(*numberValue).Format(time.DateOnly)
+			}
+			return cell.FormattedValue
+		case "DATE_TIME":
+			if numberValue != nil {
+				return fromSheetsSerialDate(*numberValue).Format(DATE_TIME_LAYOUT)
+			}
+			return cell.FormattedValue
+		case "TIME":
+			return cell.FormattedValue
+		}
+	}
+
+	effectiveValue := cell.EffectiveValue
+	switch {
+	case effectiveValue.NumberValue != nil:
+		return *effectiveValue.NumberValue
+	case effectiveValue.BoolValue != nil:
+		return *effectiveValue.BoolValue
+	case effectiveValue.StringValue != nil:
+		return *effectiveValue.StringValue
+	default:
+		// Errors like #DIV/0! only have a formatted value
+		return cell.FormattedValue
+	}
+}
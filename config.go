@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_FILE_PERMISSIONS = 0644
+
+var DEFAULT_SCOPES []string = []string{"https://www.googleapis.com/auth/spreadsheets", "https://www.googleapis.com/auth/drive"}
+
+// The config file is optional, and can also be set with -config or SHEETS_API_CONFIG
+const DEFAULT_CONFIG_FILE = "config.json"
+
+/*
+Everything about the server that can be configured. Each setting comes from, in order of precedence, a command line
+flag, an env var, the JSON config file, and then the default from defaultConfig.
+*/
+type Config struct {
+	ListenAddress     string
+	AuthMode          string
+	CredentialsFile   string
+	TokenFile         string
+	ServiceAccountKey string
+	RegistryBackend   string
+	RegistryPath      string
+	Scopes            []string
+	FilePermissions   FileMode
+	// How long the server waits to read a whole request, and to write a whole response
+	ReadTimeout  Duration
+	WriteTimeout Duration
+	// How long the server waits for in-flight requests to finish when it's shutting down
+	ShutdownTimeout Duration
+	// How long a single attempt at a Sheets or Drive call can take
+	GoogleAPITimeout Duration
+	// How long to keep retrying a Sheets or Drive call that failed with a quota or server error, 0 turns retries off
+	RetryMaxElapsed Duration
+	DefaultPageSize int
+	// How long a sheet's structure and id column are cached before checking whether the spreadsheet has changed, 0 turns
+	// the cache off
+	CacheTTL Duration
+	// Makes readSheetData return the old SheetData map keyed by "Row<n>" instead of the Rows array, for clients that
+	// haven't moved over yet
+	LegacySheetData bool
+}
+
+var serverConfig *Config
+
+// How much of WriteTimeout is kept back for writing the response, the rest is how long a request has for its Google calls
+const RESPONSE_WRITE_MARGIN = 2 * time.Second
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress:    "127.0.0.1:3333",
+		AuthMode:         AUTH_MODE_OAUTH,
+		CredentialsFile:  "credentials.json",
+		TokenFile:        "token.json",
+		RegistryBackend:  "json",
+		Scopes:           DEFAULT_SCOPES,
+		FilePermissions:  DEFAULT_FILE_PERMISSIONS,
+		ReadTimeout:      Duration(30 * time.Second),
+		WriteTimeout:     Duration(60 * time.Second),
+		ShutdownTimeout:  Duration(30 * time.Second),
+		GoogleAPITimeout: Duration(15 * time.Second),
+		RetryMaxElapsed:  Duration(20 * time.Second),
+		DefaultPageSize:  10,
+		CacheTTL:         Duration(30 * time.Second),
+	}
+}
+
+// One setting that can be set by flag or env var. The value is parsed from a string the same way for both.
+type configOption struct {
+	flagName string
+	envName  string
+	usage    string
+	set      func(config *Config, value string) error
+}
+
+var configOptions []configOption = []configOption{
+	{"listen", "SHEETS_API_LISTEN_ADDRESS", "address the server listens on", func(config *Config, value string) error {
+		config.ListenAddress = value
+		return nil
+	}},
+	{"auth", "GOOGLE_AUTH_MODE", "how to authenticate with Google: oauth, service-account or adc", func(config *Config, value string) error {
+		config.AuthMode = value
+		return nil
+	}},
+	{"credentials", "GOOGLE_OAUTH_CREDENTIALS", "path to the OAuth client credentials file, for -auth=oauth", func(config *Config, value string) error {
+		config.CredentialsFile = value
+		return nil
+	}},
+	{"token", "GOOGLE_OAUTH_TOKEN", "path to the file the user's OAuth token is saved in, for -auth=oauth", func(config *Config, value string) error {
+		config.TokenFile = value
+		return nil
+	}},
+	{"service-account-key", "GOOGLE_SERVICE_ACCOUNT_KEY", "path to a service account JSON key file, for -auth=service-account", func(config *Config, value string) error {
+		config.ServiceAccountKey = value
+		return nil
+	}},
+	{"registry", "SPREADSHEET_REGISTRY", "spreadsheet registry backend: json or bolt", func(config *Config, value string) error {
+		config.RegistryBackend = value
+		return nil
+	}},
+	{"registry-path", "SPREADSHEET_REGISTRY_PATH", "where the spreadsheet registry is stored", func(config *Config, value string) error {
+		config.RegistryPath = value
+		return nil
+	}},
+	{"scopes", "GOOGLE_SCOPES", "comma separated Google OAuth scopes", func(config *Config, value string) error {
+		config.Scopes = splitList(value)
+		return nil
+	}},
+	{"file-permissions", "SHEETS_API_FILE_PERMISSIONS", "permissions for files the server creates, in octal", func(config *Config, value string) error {
+		return config.FilePermissions.parse(value)
+	}},
+	{"read-timeout", "SHEETS_API_READ_TIMEOUT", "how long to wait to read a request, e.g. 30s", func(config *Config, value string) error {
+		return config.ReadTimeout.parse(value)
+	}},
+	{"write-timeout", "SHEETS_API_WRITE_TIMEOUT", "how long to wait to write a response, e.g. 60s", func(config *Config, value string) error {
+		return config.WriteTimeout.parse(value)
+	}},
+	{"shutdown-timeout", "SHEETS_API_SHUTDOWN_TIMEOUT", "how long to wait for in-flight requests when shutting down, e.g. 30s", func(config *Config, value string) error {
+		return config.ShutdownTimeout.parse(value)
+	}},
+	{"google-api-timeout", "SHEETS_API_GOOGLE_TIMEOUT", "how long a single attempt at a Sheets or Drive call can take, e.g. 15s", func(config *Config, value string) error {
+		return config.GoogleAPITimeout.parse(value)
+	}},
+	{"retry-max-elapsed", "SHEETS_API_RETRY_MAX_ELAPSED", "how long to keep retrying Sheets and Drive quota and server errors, 0 to not retry", func(config *Config, value string) error {
+		return config.RetryMaxElapsed.parse(value)
+	}},
+	{"default-page-size", "SHEETS_API_DEFAULT_PAGE_SIZE", "number of rows returned when no limit is given", func(config *Config, value string) error {
+		pageSize, err := strconv.Atoi(value)
+		config.DefaultPageSize = pageSize
+		return err
+	}},
+	{"cache-ttl", "SHEETS_API_CACHE_TTL", "how long sheet structure is cached before checking for changes, 0 to not cache", func(config *Config, value string) error {
+		return config.CacheTTL.parse(value)
+	}},
+	{"legacy-sheet-data", "SHEETS_API_LEGACY_SHEET_DATA", "true to return readSheetData rows as the old SheetData map", func(config *Config, value string) error {
+		legacySheetData, err := strconv.ParseBool(value)
+		config.LegacySheetData = legacySheetData
+		return err
+	}},
+}
+
+/*
+Builds the config from the command line args (without the program name), env vars and config file, then validates it.
+The config file only has to exist if it was asked for by name.
+*/
+func loadConfig(args []string) (*Config, error) {
+	flagSet := flag.NewFlagSet("google-sheets-api", flag.ContinueOnError)
+	configFile := flagSet.String("config", "", "path to a JSON config file (default "+DEFAULT_CONFIG_FILE+")")
+	var flagValues map[string]*string = make(map[string]*string)
+	for _, option := range configOptions {
+		flagValues[option.flagName] = flagSet.String(option.flagName, "", option.usage+" (env "+option.envName+")")
+	}
+
+	err := flagSet.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	config := defaultConfig()
+
+	configFilePath := *configFile
+	if configFilePath == "" {
+		configFilePath = os.Getenv("SHEETS_API_CONFIG")
+	}
+	err = config.loadFile(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, option := range configOptions {
+		if value, ok := os.LookupEnv(option.envName); ok && value != "" {
+			err = option.set(config, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", option.envName, err)
+			}
+		}
+	}
+
+	// Only flags that were actually passed override, so an unset flag doesn't wipe out an env var or the config file
+	flagSet.Visit(func(setFlag *flag.Flag) {
+		if err != nil || setFlag.Name == "config" {
+			return
+		}
+		for _, option := range configOptions {
+			if option.flagName == setFlag.Name {
+				if setErr := option.set(config, *flagValues[setFlag.Name]); setErr != nil {
+					err = fmt.Errorf("invalid -%s: %v", setFlag.Name, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if config.RegistryPath == "" && config.RegistryBackend == "bolt" {
+		config.RegistryPath = "data/spreadsheetIDs.db"
+	} else if config.RegistryPath == "" {
+		config.RegistryPath = "data/spreadsheetIDs.json"
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return config, nil
+}
+
+func (config *Config) loadFile(path string) error {
+	required := path != ""
+	if path == "" {
+		path = DEFAULT_CONFIG_FILE
+	}
+
+	configBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read config file: %v", err)
+	}
+
+	// Settings missing from the file keep their defaults, and a typo in a setting name is an error rather than ignored
+	decoder := json.NewDecoder(bytes.NewReader(configBytes))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("Unable to decode config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (config *Config) validate() error {
+	if _, _, err := net.SplitHostPort(config.ListenAddress); err != nil {
+		return fmt.Errorf("ListenAddress %q must be host:port", config.ListenAddress)
+	}
+
+	authModes := []string{AUTH_MODE_OAUTH, AUTH_MODE_SERVICE_ACCOUNT, AUTH_MODE_ADC}
+	if !slices.Contains(authModes, config.AuthMode) {
+		return fmt.Errorf("AuthMode %q must be one of %v", config.AuthMode, authModes)
+	}
+	if config.AuthMode == AUTH_MODE_OAUTH && (config.CredentialsFile == "" || config.TokenFile == "") {
+		return fmt.Errorf("CredentialsFile and TokenFile are required for the %s auth mode", AUTH_MODE_OAUTH)
+	}
+	if config.AuthMode == AUTH_MODE_SERVICE_ACCOUNT && config.ServiceAccountKey == "" {
+		return fmt.Errorf("ServiceAccountKey is required for the %s auth mode", AUTH_MODE_SERVICE_ACCOUNT)
+	}
+
+	if config.RegistryBackend != "json" && config.RegistryBackend != "bolt" {
+		return fmt.Errorf("RegistryBackend %q must be json or bolt", config.RegistryBackend)
+	}
+	if len(config.Scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	if config.FilePermissions == 0 || config.FilePermissions > 0777 {
+		return fmt.Errorf("FilePermissions %s must be between 0001 and 0777", config.FilePermissions)
+	}
+
+	for name, timeout := range map[string]Duration{"ReadTimeout": config.ReadTimeout, "WriteTimeout": config.WriteTimeout, "ShutdownTimeout": config.ShutdownTimeout, "GoogleAPITimeout": config.GoogleAPITimeout} {
+		if timeout <= 0 {
+			return fmt.Errorf("%s must be more than 0", name)
+		}
+	}
+
+	if config.RetryMaxElapsed < 0 {
+		return errors.New("RetryMaxElapsed can't be negative")
+	}
+	if time.Duration(config.WriteTimeout) <= RESPONSE_WRITE_MARGIN {
+		return fmt.Errorf("WriteTimeout must be more than %v, which is kept back for writing the response", RESPONSE_WRITE_MARGIN)
+	}
+	if config.CacheTTL < 0 {
+		return errors.New("CacheTTL can't be negative")
+	}
+
+	if config.DefaultPageSize < 1 || config.DefaultPageSize > MAX_PAGE_SIZE {
+		return fmt.Errorf("DefaultPageSize must be between 1 and %d", MAX_PAGE_SIZE)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Responds with the config the server is running with, after flags, env vars and the config file have been applied
+func debugConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, serverConfig)
+}
+
+// A time.Duration that's written as a string like "30s" in JSON, rather than a number of nanoseconds
+type Duration time.Duration
+
+func (duration *Duration) parse(value string) error {
+	parsedDuration, err := time.ParseDuration(value)
+	*duration = Duration(parsedDuration)
+	return err
+}
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+func (duration *Duration) UnmarshalJSON(durationBytes []byte) error {
+	var value string
+	err := json.Unmarshal(durationBytes, &value)
+	if err != nil {
+		return errors.New("durations must be strings like \"30s\"")
+	}
+	return duration.parse(value)
+}
+
+// An os.FileMode that's written as an octal string like "0644" in JSON
+type FileMode os.FileMode
+
+func (fileMode *FileMode) parse(value string) error {
+	parsedMode, err := strconv.ParseUint(value, 8, 32)
+	*fileMode = FileMode(parsedMode)
+	return err
+}
+
+func (fileMode FileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(fileMode))
+}
+
+func (fileMode FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fileMode.String())
+}
+
+func (fileMode *FileMode) UnmarshalJSON(fileModeBytes []byte) error {
+	var value string
+	err := json.Unmarshal(fileModeBytes, &value)
+	if err != nil {
+		return errors.New("file permissions must be octal strings like \"0644\"")
+	}
+	return fileMode.parse(value)
+}
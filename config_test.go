@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	// Each setting is set by the file, overridden by the env var and then by the flag, to check every step of the order
+	configFile := writeTestConfigFile(t, `{
+		"ListenAddress": "127.0.0.1:1111",
+		"RegistryBackend": "bolt",
+		"DefaultPageSize": 20,
+		"CacheTTL": "1m"
+	}`)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want func(config *Config) bool
+	}{
+		{
+			name: "defaults without a file",
+			want: func(config *Config) bool {
+				return config.ListenAddress == "127.0.0.1:3333" && config.DefaultPageSize == 10 && config.RegistryPath == "data/spreadsheetIDs.json"
+			},
+		},
+		{
+			name: "file over defaults",
+			args: []string{"-config", configFile},
+			want: func(config *Config) bool {
+				return config.ListenAddress == "127.0.0.1:1111" && config.DefaultPageSize == 20 &&
+					config.CacheTTL == Duration(time.Minute) && config.RegistryPath == "data/spreadsheetIDs.db" &&
+					config.ReadTimeout == Duration(30*time.Second)
+			},
+		},
+		{
+			name: "file from env var",
+			env:  map[string]string{"SHEETS_API_CONFIG": configFile},
+			want: func(config *Config) bool {
+				return config.ListenAddress == "127.0.0.1:1111"
+			},
+		},
+		{
+			name: "env over file",
+			env:  map[string]string{"SHEETS_API_LISTEN_ADDRESS": "127.0.0.1:2222", "SHEETS_API_DEFAULT_PAGE_SIZE": "30"},
+			args: []string{"-config", configFile},
+			want: func(config *Config) bool {
+				return config.ListenAddress == "127.0.0.1:2222" && config.DefaultPageSize == 30 && config.CacheTTL == Duration(time.Minute)
+			},
+		},
+		{
+			name: "empty env var doesn't override",
+			env:  map[string]string{"SHEETS_API_LISTEN_ADDRESS": ""},
+			args: []string{"-config", configFile},
+			want: func(config *Config) bool {
+				return config.ListenAddress == "127.0.0.1:1111"
+			},
+		},
+		{
+			name: "flag over env and file",
+			env:  map[string]string{"SHEETS_API_LISTEN_ADDRESS": "127.0.0.1:2222", "SHEETS_API_DEFAULT_PAGE_SIZE": "30"},
+			args: []string{"-config", configFile, "-listen", "127.0.0.1:4444"},
+			want: func(config *Config) bool {
+				return config.ListenAddress == "127.0.0.1:4444" && config.DefaultPageSize == 30 && config.RegistryBackend == "bolt"
+			},
+		},
+		{
+			name: "flag -config over env var",
+			env:  map[string]string{"SHEETS_API_CONFIG": filepath.Join(t.TempDir(), "missing.json")},
+			args: []string{"-config", configFile},
+			want: func(config *Config) bool {
+				return config.ListenAddress == "127.0.0.1:1111"
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			// Without -config, config.json in the working directory would be read
+			chdirTemp(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			config, err := loadConfig(test.args)
+			if err != nil {
+				t.Fatalf("loadConfig(%v) error = %v", test.args, err)
+			}
+			if !test.want(config) {
+				t.Errorf("loadConfig(%v) = %+v", test.args, config)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "unknown setting in file",
+			file:    `{"ListenAdress": "127.0.0.1:1111"}`,
+			wantErr: "unknown field",
+		},
+		{
+			name:    "invalid env var",
+			env:     map[string]string{"SHEETS_API_DEFAULT_PAGE_SIZE": "ten"},
+			wantErr: "invalid SHEETS_API_DEFAULT_PAGE_SIZE",
+		},
+		{
+			name:    "invalid flag",
+			args:    []string{"-read-timeout", "soon"},
+			wantErr: "invalid -read-timeout",
+		},
+		{
+			name:    "write timeout leaves no time for the request",
+			args:    []string{"-write-timeout", "2s"},
+			wantErr: "WriteTimeout must be more than",
+		},
+		{
+			name:    "missing named config file",
+			args:    []string{"-config", "missing.json"},
+			wantErr: "Unable to read config file",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			chdirTemp(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			args := test.args
+			if test.file != "" {
+				args = append([]string{"-config", writeTestConfigFile(t, test.file)}, args...)
+			}
+
+			_, err := loadConfig(args)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("loadConfig(%v) error = %v, want one containing %q", args, err, test.wantErr)
+			}
+		})
+	}
+}
+
+// Empty env vars are ignored by loadConfig, so this keeps the environment the tests run in from changing the results
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("SHEETS_API_CONFIG", "")
+	for _, option := range configOptions {
+		t.Setenv(option.envName, "")
+	}
+}
+
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(workingDir) })
+}
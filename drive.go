@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const SPREADSHEET_MIME_TYPE = "application/vnd.google-apps.spreadsheet"
+
+// The most files Drive returns in one Files.List page
+const MAX_DRIVE_PAGE_SIZE = 1000
+
+var ErrSpreadsheetNotFound = errors.New("no spreadsheet with that title was found")
+var ErrAmbiguousSpreadsheetTitle = errors.New("more than one spreadsheet has that title")
+
+/*
+Looks a spreadsheet's ID up by its title. The registry is checked first, and if the title isn't there we ask Drive for
+a spreadsheet with that exact name and save what it finds back to the registry. Returns ErrSpreadsheetNotFound or
+ErrAmbiguousSpreadsheetTitle when Drive has zero or several spreadsheets with the title.
+*/
+func getSpreadsheetId(ctx context.Context, spreadsheetTitle string) (string, error) {
+	spreadsheetId, ok, err := spreadsheetRegistry.Lookup(spreadsheetTitle)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read spreadsheet registry: %w", err)
+	}
+	if ok {
+		return spreadsheetId, nil
+	}
+
+	if spreadsheetTitle == "" {
+		return "", ErrSpreadsheetNotFound
+	}
+
+	matchingFiles, err := findSpreadsheetsByName(ctx, spreadsheetTitle)
+	if err != nil {
+		return "", fmt.Errorf("Unable to search Drive for spreadsheet: %w", err)
+	}
+
+	switch len(matchingFiles) {
+	case 0:
+		return "", ErrSpreadsheetNotFound
+	case 1:
+		spreadsheetId = matchingFiles[0].Id
+	default:
+		return "", ErrAmbiguousSpreadsheetTitle
+	}
+
+	err = spreadsheetRegistry.Register(spreadsheetTitle, spreadsheetId)
+	if err != nil {
+		// The lookup still worked, it just won't be cached for next time
+		fmt.Printf("Unable to save spreadsheet %s (%s) to the registry: %v\n", spreadsheetTitle, spreadsheetId, err)
+	}
+	return spreadsheetId, nil
+}
+
+// Lists every spreadsheet in Drive (not in the trash) named exactly name, going through every page of results
+func findSpreadsheetsByName(ctx context.Context, name string) ([]*drive.File, error) {
+	query := fmt.Sprintf("name = '%s' and mimeType = '%s' and trashed = false", escapeDriveQueryValue(name), SPREADSHEET_MIME_TYPE)
+
+	var matchingFiles []*drive.File
+	err := driveService.Files.List().
+		Q(query).
+		Fields("nextPageToken, files(id, name)").
+		PageSize(100).
+		Pages(ctx, func(fileList *drive.FileList) error {
+			matchingFiles = append(matchingFiles, fileList.Files...)
+			return nil
+		})
+	return matchingFiles, err
+}
+
+// Drive query strings are wrapped in single quotes, so quotes and backslashes in the value need escaping
+func escapeDriveQueryValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+func writeSpreadsheetLookupError(w http.ResponseWriter, r *http.Request, spreadsheetTitle string, err error) {
+	switch {
+	case errors.Is(err, ErrSpreadsheetNotFound):
+		writeError(w, r, http.StatusNotFound, "spreadsheet_not_found", "Unable to find spreadsheet "+spreadsheetTitle)
+	case errors.Is(err, ErrAmbiguousSpreadsheetTitle):
+		writeError(w, r, http.StatusConflict, "ambiguous_spreadsheet_title", "More than one spreadsheet is titled "+spreadsheetTitle+", add the one you want to the registry")
+	default:
+		var googleErr *googleapi.Error
+		if errors.As(err, &googleErr) || r.Context().Err() != nil || isTimeout(err) {
+			writeGoogleError(w, r, err, "Unable to look up spreadsheet "+spreadsheetTitle)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, "spreadsheet_lookup_failed", "Unable to look up spreadsheet "+spreadsheetTitle+": "+err.Error())
+	}
+}
+
+type SpreadsheetListEntry struct {
+	Title         string
+	SpreadsheetID string
+	InRegistry    bool
+	InDrive       bool
+	// Set when the registry has the spreadsheet under a different title than Drive does
+	RegistryTitle string `json:",omitempty"`
+}
+
+/*
+Lists one page of the spreadsheets Drive can see, flagging which of them are in the registry. Registry entries that
+Drive doesn't have can't be spotted from a single page, so the first page ends with all of them, from
+listRegistryOnlySpreadsheets.
+*/
+func listSpreadsheets(ctx context.Context, pageSize int, pageToken string) ([]SpreadsheetListEntry, string, error) {
+	registeredSpreadsheets, err := spreadsheetRegistry.List()
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to read spreadsheet registry: %w", err)
+	}
+
+	var registeredTitlesById map[string][]string = make(map[string][]string)
+	for title, spreadsheetId := range registeredSpreadsheets {
+		registeredTitlesById[spreadsheetId] = append(registeredTitlesById[spreadsheetId], title)
+	}
+
+	fileList, err := driveService.Files.List().
+		Q(fmt.Sprintf("mimeType = '%s' and trashed = false", SPREADSHEET_MIME_TYPE)).
+		Fields("nextPageToken, files(id, name)").
+		OrderBy("name").
+		PageSize(int64(pageSize)).
+		PageToken(pageToken).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var spreadsheetList []SpreadsheetListEntry = make([]SpreadsheetListEntry, 0)
+	for _, file := range fileList.Files {
+		entry := SpreadsheetListEntry{Title: file.Name, SpreadsheetID: file.Id, InDrive: true}
+
+		registeredTitles := registeredTitlesById[file.Id]
+		if len(registeredTitles) > 0 {
+			entry.InRegistry = true
+			if !slices.Contains(registeredTitles, file.Name) {
+				entry.RegistryTitle = registeredTitles[0]
+			}
+		}
+		spreadsheetList = append(spreadsheetList, entry)
+	}
+
+	if pageToken == "" {
+		registryOnlySpreadsheets, err := listRegistryOnlySpreadsheets(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		spreadsheetList = append(spreadsheetList, registryOnlySpreadsheets...)
+	}
+
+	return spreadsheetList, fileList.NextPageToken, nil
+}
+
+/*
+Lists the registry entries that Drive doesn't have: deleted or trashed spreadsheets, or ones this account lost access
+to. Drive is paged through once for the ids of every spreadsheet it can see, MAX_DRIVE_PAGE_SIZE at a time, rather than
+looking each registry entry up on its own.
+*/
+func listRegistryOnlySpreadsheets(ctx context.Context) ([]SpreadsheetListEntry, error) {
+	registeredSpreadsheets, err := spreadsheetRegistry.List()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read spreadsheet registry: %w", err)
+	}
+
+	var idsInDrive map[string]bool = make(map[string]bool)
+	err = driveService.Files.List().
+		Q(fmt.Sprintf("mimeType = '%s' and trashed = false", SPREADSHEET_MIME_TYPE)).
+		Fields("nextPageToken, files(id)").
+		PageSize(MAX_DRIVE_PAGE_SIZE).
+		Pages(ctx, func(fileList *drive.FileList) error {
+			for _, file := range fileList.Files {
+				idsInDrive[file.Id] = true
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var registeredTitles []string
+	for title := range registeredSpreadsheets {
+		registeredTitles = append(registeredTitles, title)
+	}
+	slices.Sort(registeredTitles)
+
+	var spreadsheetList []SpreadsheetListEntry = make([]SpreadsheetListEntry, 0)
+	for _, title := range registeredTitles {
+		spreadsheetId := registeredSpreadsheets[title]
+		if !idsInDrive[spreadsheetId] {
+			spreadsheetList = append(spreadsheetList, SpreadsheetListEntry{Title: title, SpreadsheetID: spreadsheetId, InRegistry: true})
+		}
+	}
+	return spreadsheetList, nil
+}
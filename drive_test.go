@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// Points driveService at a Drive that can see the files, which every files.list call returns as a single page
+func newFakeDrive(t *testing.T, files []*drive.File) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&drive.FileList{Files: files})
+	}))
+	t.Cleanup(server.Close)
+
+	previousService := driveService
+	service, err := drive.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	driveService = service
+	t.Cleanup(func() { driveService = previousService })
+}
+
+func TestListSpreadsheets(t *testing.T) {
+	newFakeDrive(t, []*drive.File{{Id: "1", Name: "Budget"}, {Id: "2", Name: "Notes"}})
+
+	previousRegistry := spreadsheetRegistry
+	spreadsheetRegistry = newJsonFileRegistry(filepath.Join(t.TempDir(), "spreadsheetIDs.json"), 0600)
+	t.Cleanup(func() { spreadsheetRegistry = previousRegistry })
+	for title, spreadsheetId := range map[string]string{"Old budget": "1", "Deleted": "3"} {
+		if err := spreadsheetRegistry.Register(title, spreadsheetId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		pageToken string
+		want      []SpreadsheetListEntry
+	}{
+		{
+			name: "first page ends with the registry entries Drive doesn't have",
+			want: []SpreadsheetListEntry{
+				{Title: "Budget", SpreadsheetID: "1", InRegistry: true, InDrive: true, RegistryTitle: "Old budget"},
+				{Title: "Notes", SpreadsheetID: "2", InDrive: true},
+				{Title: "Deleted", SpreadsheetID: "3", InRegistry: true},
+			},
+		},
+		{
+			name:      "later pages only have Drive's spreadsheets",
+			pageToken: "next",
+			want: []SpreadsheetListEntry{
+				{Title: "Budget", SpreadsheetID: "1", InRegistry: true, InDrive: true, RegistryTitle: "Old budget"},
+				{Title: "Notes", SpreadsheetID: "2", InDrive: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _, err := listSpreadsheets(context.Background(), 10, test.pageToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("listSpreadsheets = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestListSpreadsheetsEmpty(t *testing.T) {
+	newFakeDrive(t, nil)
+
+	previousRegistry := spreadsheetRegistry
+	spreadsheetRegistry = newJsonFileRegistry(filepath.Join(t.TempDir(), "spreadsheetIDs.json"), 0600)
+	t.Cleanup(func() { spreadsheetRegistry = previousRegistry })
+
+	got, _, err := listSpreadsheets(context.Background(), 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A nil slice would be null in the response rather than []
+	if got == nil || len(got) != 0 {
+		t.Errorf("listSpreadsheets = %#v, want an empty list", got)
+	}
+}
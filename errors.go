@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/api/googleapi"
+)
+
+/*
+Every error response has this shape, so clients only need to handle one format:
+
+	{"Error": {"Code": "sheet_not_found", "Message": "...", "GoogleStatus": 404, "RequestID": "..."}}
+
+GoogleStatus is only set when the error came from a Sheets or Drive call, and FieldErrors only for schema violations.
+*/
+type ErrorResponse struct {
+	Error ErrorDetails
+}
+
+type ErrorDetails struct {
+	Code         string
+	Message      string
+	GoogleStatus int `json:",omitempty"`
+	RequestID    string
+	FieldErrors  []FieldError `json:",omitempty"`
+}
+
+type requestIdContextKey struct{}
+
+/*
+Gives every request an ID, which is sent back in the X-Request-Id header and in error responses so that an error a
+client sees can be matched up with the server logs. It also turns a panic in a handler into a 500 error response.
+The request's context runs out RESPONSE_WRITE_MARGIN before WriteTimeout, so that every Google call the handler makes,
+retries included, is done in time for the response to be written before the server closes the connection.
+*/
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := uuid.New().String()
+		w.Header().Set("X-Request-Id", requestId)
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(serverConfig.WriteTimeout)-RESPONSE_WRITE_MARGIN)
+		defer cancel()
+		r = r.WithContext(context.WithValue(ctx, requestIdContextKey{}, requestId))
+
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			log.Printf("[%s] Panic while handling %s %s: %v", requestId, r.Method, r.URL.Path, recovered)
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getRequestId(r *http.Request) string {
+	requestId, _ := r.Context().Value(requestIdContextKey{}).(string)
+	return requestId
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	writeErrorDetails(w, r, status, ErrorDetails{Code: code, Message: message})
+}
+
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, details ErrorDetails) {
+	details.RequestID = getRequestId(r)
+	if status >= http.StatusInternalServerError {
+		log.Printf("[%s] %d %s: %s", details.RequestID, status, details.Code, details.Message)
+	}
+
+	responseBodyBytes, err := json.Marshal(ErrorResponse{Error: details})
+	if err != nil {
+		http.Error(w, details.Message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseBodyBytes)
+}
+
+/*
+Responds with an error from a Sheets or Drive call. Google's status is passed through when it means the same thing
+coming from us (a 404 for a sheet that doesn't exist is still a 404), and anything that's Google's or our own
+credentials' fault becomes a 502.
+*/
+func writeGoogleError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	// The client disconnected (or the server is shutting down) and the call was cancelled, so nobody is waiting for a response
+	if !isReauthenticationRequired(err) && errors.Is(r.Context().Err(), context.Canceled) {
+		log.Printf("[%s] %s: request cancelled: %v", getRequestId(r), message, err)
+		return
+	}
+	status, details := googleErrorDetails(r, err, message)
+	writeErrorDetails(w, r, status, details)
+}
+
+// The status and error details for an error from a Sheets or Drive call, for responses that report more than one error
+func googleErrorDetails(r *http.Request, err error, message string) (int, ErrorDetails) {
+	if isReauthenticationRequired(err) {
+		return http.StatusServiceUnavailable, ErrorDetails{Code: "reauthentication_required", Message: message + ": Google has rejected our credentials, sign in again with `go run . auth login`"}
+	}
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, ErrorDetails{Code: "request_timeout", Message: message + ": the request ran out of time waiting for Google"}
+	}
+	if isTimeout(err) {
+		return http.StatusGatewayTimeout, ErrorDetails{Code: "google_api_timeout", Message: message + ": Google took too long to respond"}
+	}
+
+	var googleErr *googleapi.Error
+	if !errors.As(err, &googleErr) {
+		log.Printf("[%s] %s: %v", getRequestId(r), message, err)
+		return http.StatusBadGateway, ErrorDetails{Code: "google_api_error", Message: message}
+	}
+
+	if googleErr.Message != "" {
+		message = message + ": " + googleErr.Message
+	}
+	return httpStatusForGoogleStatus(googleErr.Code), ErrorDetails{
+		Code:         "google_api_error",
+		Message:      message,
+		GoogleStatus: googleErr.Code,
+	}
+}
+
+// Each attempt at a Google call times out after the GoogleAPITimeout setting, which isn't a googleapi.Error
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func httpStatusForGoogleStatus(googleStatus int) int {
+	switch {
+	case googleStatus == http.StatusUnauthorized:
+		// Our credentials were rejected, which isn't something the client can fix
+		return http.StatusBadGateway
+	case googleStatus >= 400 && googleStatus < 500:
+		return googleStatus
+	case googleStatus == http.StatusServiceUnavailable, googleStatus == http.StatusGatewayTimeout:
+		// Both mean trying again later may work, which the client should know
+		return googleStatus
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, responseBody any) {
+	responseBodyBytes, err := json.Marshal(responseBody)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Error turning response body to JSON bytes. Error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseBodyBytes)
+}
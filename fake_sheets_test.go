@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+const FAKE_SHEET_TITLE = "Sheet1"
+const FAKE_SHEET_ID = 1
+
+/*
+A Sheets API with one spreadsheet holding one sheet, FAKE_SHEET_TITLE, for testing code that reads and changes rows.
+It only knows the calls and ranges the server makes: reading whole rows ("3:5") or whole columns ("A:B") with grid
+data, and BatchUpdates that delete rows or update cells.
+*/
+type fakeSheets struct {
+	mu   sync.Mutex
+	rows [][]string
+	// Called with the lock released before each BatchUpdate is applied, so tests can line requests up
+	beforeBatchUpdate func()
+}
+
+// Points sheetsService at a fake spreadsheet with the rows, where rows[0] is the column header row
+func newFakeSheets(t *testing.T, rows [][]string) *fakeSheets {
+	t.Helper()
+	fake := &fakeSheets{rows: rows}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	previousService := sheetsService
+	service, err := sheets.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheetsService = service
+	t.Cleanup(func() { sheetsService = previousService })
+	return fake
+}
+
+func (fake *fakeSheets) ids() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	var ids []string
+	for _, row := range fake.rows {
+		if len(row) == 0 {
+			ids = append(ids, "")
+		} else {
+			ids = append(ids, row[0])
+		}
+	}
+	return ids
+}
+
+func (fake *fakeSheets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet:
+		fake.get(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":batchUpdate"):
+		fake.batchUpdate(w, r)
+	default:
+		http.Error(w, "not faked: "+r.Method+" "+r.URL.Path, http.StatusNotImplemented)
+	}
+}
+
+func (fake *fakeSheets) get(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	sheet := &sheets.Sheet{Properties: &sheets.SheetProperties{SheetId: FAKE_SHEET_ID, Title: FAKE_SHEET_TITLE}}
+	for _, a1Range := range r.URL.Query()["ranges"] {
+		_, a1Range, _ = strings.Cut(a1Range, "!")
+		start, end, ok := strings.Cut(a1Range, ":")
+		if !ok {
+			http.Error(w, "not faked: range "+a1Range, http.StatusNotImplemented)
+			return
+		}
+
+		startRow, endRow := 0, len(fake.rows)
+		startColumn, endColumn := 0, -1
+		if startNumber, err := strconv.Atoi(start); err == nil {
+			endNumber, _ := strconv.Atoi(end)
+			startRow, endRow = startNumber-1, min(endNumber, len(fake.rows))
+		} else {
+			startColumn, endColumn = int(start[0]-'A'), int(end[0]-'A')+1
+		}
+
+		gridData := &sheets.GridData{StartRow: int64(startRow)}
+		for rowIndex := startRow; rowIndex < endRow; rowIndex++ {
+			rowData := &sheets.RowData{}
+			row := fake.rows[rowIndex]
+			for columnIndex := startColumn; columnIndex < len(row) && (endColumn < 0 || columnIndex < endColumn); columnIndex++ {
+				value := row[columnIndex]
+				rowData.Values = append(rowData.Values, &sheets.CellData{FormattedValue: value, EffectiveValue: &sheets.ExtendedValue{StringValue: &value}})
+			}
+			gridData.RowData = append(gridData.RowData, rowData)
+		}
+		// Like Sheets, blank rows at the end of a range are left off
+		for len(gridData.RowData) > 0 && len(gridData.RowData[len(gridData.RowData)-1].Values) == 0 {
+			gridData.RowData = gridData.RowData[:len(gridData.RowData)-1]
+		}
+		sheet.Data = append(sheet.Data, gridData)
+	}
+
+	json.NewEncoder(w).Encode(&sheets.Spreadsheet{Sheets: []*sheets.Sheet{sheet}})
+}
+
+func (fake *fakeSheets) batchUpdate(w http.ResponseWriter, r *http.Request) {
+	var batchUpdate sheets.BatchUpdateSpreadsheetRequest
+	if err := json.NewDecoder(r.Body).Decode(&batchUpdate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if fake.beforeBatchUpdate != nil {
+		fake.beforeBatchUpdate()
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	for _, request := range batchUpdate.Requests {
+		switch {
+		case request.DeleteRange != nil:
+			deleteRange := request.DeleteRange.Range
+			fake.rows = append(fake.rows[:deleteRange.StartRowIndex], fake.rows[deleteRange.EndRowIndex:]...)
+		case request.UpdateCells != nil && request.UpdateCells.Start != nil:
+			start := request.UpdateCells.Start
+			row := fake.rows[start.RowIndex]
+			for columnOffset, cell := range request.UpdateCells.Rows[0].Values {
+				columnIndex := int(start.ColumnIndex) + columnOffset
+				for len(row) <= columnIndex {
+					row = append(row, "")
+				}
+				if cell.UserEnteredValue != nil && cell.UserEnteredValue.StringValue != nil {
+					row[columnIndex] = *cell.UserEnteredValue.StringValue
+				}
+			}
+			fake.rows[start.RowIndex] = row
+		default:
+			http.Error(w, "not faked: request", http.StatusNotImplemented)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(&sheets.BatchUpdateSpreadsheetResponse{})
+}
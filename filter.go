@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The longest filter expression that's accepted, to keep a query string from turning into a very deep parse
+const MAX_FILTER_LENGTH = 2000
+
+/*
+readSheetData reads a filtered sheet FILTER_SCAN_CHUNK_ROWS rows at a time until the page is full, but stops after
+MAX_FILTER_SCAN_ROWS rows so that a filter that matches almost nothing can't read a whole big sheet in one request.
+*/
+const FILTER_SCAN_CHUNK_ROWS = 500
+const MAX_FILTER_SCAN_ROWS = 5000
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+/*
+A parsed filter expression, matched against objects as rowToObject returns them. The language is small:
+
+	name = "Ada" AND age >= 30
+	status != done OR (priority > 2 AND title contains "urgent")
+
+Each comparison is a column header, an operator (=, !=, <, <=, >, >= or contains) and a value. Headers and values with
+spaces or operators in them are quoted with " or ', with a quote inside doubled. Unquoted values that are numbers or
+true/false are compared as numbers or booleans, everything else as text. AND binds tighter than OR, parentheses group,
+and AND, OR and contains don't care about case.
+*/
+type filterExpression interface {
+	matches(object map[string]any) bool
+}
+
+type filterAnd struct {
+	left, right filterExpression
+}
+
+func (and filterAnd) matches(object map[string]any) bool {
+	return and.left.matches(object) && and.right.matches(object)
+}
+
+type filterOr struct {
+	left, right filterExpression
+}
+
+func (or filterOr) matches(object map[string]any) bool {
+	return or.left.matches(object) || or.right.matches(object)
+}
+
+type filterComparison struct {
+	field    string
+	operator string
+	// A float64, bool or string
+	value any
+}
+
+func (comparison filterComparison) matches(object map[string]any) bool {
+	cellValue := object[comparison.field]
+
+	if comparison.operator == "contains" {
+		return strings.Contains(strings.ToLower(filterValueString(cellValue)), strings.ToLower(filterValueString(comparison.value)))
+	}
+
+	order, comparable := compareFilterValues(cellValue, comparison.value)
+	switch comparison.operator {
+	case "=":
+		return comparable && order == 0
+	case "!=":
+		return !comparable || order != 0
+	case "<":
+		return comparable && order < 0
+	case "<=":
+		return comparable && order <= 0
+	case ">":
+		return comparable && order > 0
+	case ">=":
+		return comparable && order >= 0
+	}
+	return false
+}
+
+/*
+Compares a cell's value with a value from a filter. Numbers are compared as numbers, including text cells that hold a
+number, and booleans can only be equal or not. Everything else is compared as text, which puts ISO dates in date order.
+*/
+func compareFilterValues(cellValue any, filterValue any) (int, bool) {
+	switch typedFilterValue := filterValue.(type) {
+	case float64:
+		cellNumber, ok := cellValue.(float64)
+		if cellString, isString := cellValue.(string); isString {
+			parsedNumber, err := strconv.ParseFloat(strings.TrimSpace(cellString), 64)
+			cellNumber, ok = parsedNumber, err == nil
+		}
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case cellNumber < typedFilterValue:
+			return -1, true
+		case cellNumber > typedFilterValue:
+			return 1, true
+		}
+		return 0, true
+
+	case bool:
+		cellBool, ok := cellValue.(bool)
+		if !ok {
+			cellBool, ok = parseFilterBool(filterValueString(cellValue))
+		}
+		if !ok || cellBool != typedFilterValue {
+			// Booleans have no order, so anything other than equal is just not comparable
+			return 1, ok
+		}
+		return 0, true
+	}
+
+	return strings.Compare(filterValueString(cellValue), filterValueString(filterValue)), true
+}
+
+func filterValueString(value any) string {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(typedValue)
+	}
+}
+
+func parseFilterBool(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+	return false, false
+}
+
+type filterTokenKind int
+
+const (
+	filterWord filterTokenKind = iota
+	filterQuoted
+	filterOperator
+	filterOpenParen
+	filterCloseParen
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expression)
+
+	for position := 0; position < len(runes); {
+		char := runes[position]
+		switch {
+		case unicode.IsSpace(char):
+			position++
+
+		case char == '(' || char == ')':
+			kind := filterOpenParen
+			if char == ')' {
+				kind = filterCloseParen
+			}
+			tokens = append(tokens, filterToken{kind, string(char)})
+			position++
+
+		case char == '"' || char == '\'':
+			var quoted strings.Builder
+			position++
+			for {
+				if position >= len(runes) {
+					return nil, errors.New("filter has a quote that isn't closed")
+				}
+				if runes[position] == char {
+					// A doubled quote is a quote inside the string
+					if position+1 < len(runes) && runes[position+1] == char {
+						quoted.WriteRune(char)
+						position += 2
+						continue
+					}
+					position++
+					break
+				}
+				quoted.WriteRune(runes[position])
+				position++
+			}
+			tokens = append(tokens, filterToken{filterQuoted, quoted.String()})
+
+		case strings.ContainsRune("=!<>", char):
+			operator := string(char)
+			if position+1 < len(runes) && runes[position+1] == '=' {
+				operator += "="
+			}
+			position += len(operator)
+			if operator == "!" {
+				return nil, errors.New("filter has a ! that isn't part of !=")
+			}
+			if operator == "==" {
+				operator = "="
+			}
+			tokens = append(tokens, filterToken{filterOperator, operator})
+
+		default:
+			start := position
+			for position < len(runes) && !unicode.IsSpace(runes[position]) && !strings.ContainsRune("()\"'=!<>", runes[position]) {
+				position++
+			}
+			tokens = append(tokens, filterToken{filterWord, string(runes[start:position])})
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens        []filterToken
+	position      int
+	columnHeaders []string
+}
+
+/*
+Parses a filter expression for a sheet with the given column headers. Every header in the expression has to be one of
+the sheet's, so that a typo is an error instead of a filter that never matches.
+*/
+func parseFilter(expression string, columnHeaders []string) (filterExpression, error) {
+	if len(expression) > MAX_FILTER_LENGTH {
+		return nil, fmt.Errorf("filter can be at most %d characters", MAX_FILTER_LENGTH)
+	}
+
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("filter is empty")
+	}
+
+	parser := &filterParser{tokens: tokens, columnHeaders: columnHeaders}
+	parsed, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(parser.tokens) {
+		return nil, fmt.Errorf("filter has an unexpected %q", parser.tokens[parser.position].text)
+	}
+	return parsed, nil
+}
+
+func (parser *filterParser) peek() *filterToken {
+	if parser.position >= len(parser.tokens) {
+		return nil
+	}
+	return &parser.tokens[parser.position]
+}
+
+func (parser *filterParser) nextIsKeyword(keyword string) bool {
+	token := parser.peek()
+	return token != nil && token.kind == filterWord && strings.EqualFold(token.text, keyword)
+}
+
+func (parser *filterParser) parseOr() (filterExpression, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.nextIsKeyword("OR") {
+		parser.position++
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (parser *filterParser) parseAnd() (filterExpression, error) {
+	left, err := parser.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for parser.nextIsKeyword("AND") {
+		parser.position++
+		right, err := parser.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (parser *filterParser) parseTerm() (filterExpression, error) {
+	token := parser.peek()
+	if token == nil {
+		return nil, errors.New("filter ends where a comparison was expected")
+	}
+
+	if token.kind == filterOpenParen {
+		parser.position++
+		grouped, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing := parser.peek()
+		if closing == nil || closing.kind != filterCloseParen {
+			return nil, errors.New("filter has a ( that isn't closed")
+		}
+		parser.position++
+		return grouped, nil
+	}
+
+	if token.kind != filterWord && token.kind != filterQuoted {
+		return nil, fmt.Errorf("filter has %q where a column header was expected", token.text)
+	}
+	field := token.text
+	if !slices.Contains(parser.columnHeaders, field) {
+		return nil, fmt.Errorf("filter has %q, which isn't a column header of this sheet", field)
+	}
+	parser.position++
+
+	operatorToken := parser.peek()
+	var operator string
+	switch {
+	case operatorToken != nil && operatorToken.kind == filterOperator:
+		operator = operatorToken.text
+	case parser.nextIsKeyword("contains"):
+		operator = "contains"
+	default:
+		return nil, fmt.Errorf("filter has no operator after %q", field)
+	}
+	parser.position++
+
+	valueToken := parser.peek()
+	if valueToken == nil || (valueToken.kind != filterWord && valueToken.kind != filterQuoted) {
+		return nil, fmt.Errorf("filter has no value after %q %s", field, operator)
+	}
+	parser.position++
+
+	var value any = valueToken.text
+	if valueToken.kind == filterWord {
+		if number, err := strconv.ParseFloat(valueToken.text, 64); err == nil && !math.IsInf(number, 0) && !math.IsNaN(number) {
+			value = number
+		} else if boolean, ok := parseFilterBool(valueToken.text); ok {
+			value = boolean
+		}
+	}
+	if _, isBool := value.(bool); isBool && operator != "=" && operator != "!=" {
+		return nil, fmt.Errorf("filter compares %q with %s, but true and false can only be compared with = or !=", field, operator)
+	}
+
+	return filterComparison{field: field, operator: operator, value: value}, nil
+}
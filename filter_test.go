@@ -0,0 +1,276 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       []filterToken
+		wantErr    string
+	}{
+		{
+			name:       "comparison",
+			expression: "age>=30",
+			want:       []filterToken{{filterWord, "age"}, {filterOperator, ">="}, {filterWord, "30"}},
+		},
+		{
+			name:       "double equals is equals",
+			expression: "name == Ada",
+			want:       []filterToken{{filterWord, "name"}, {filterOperator, "="}, {filterWord, "Ada"}},
+		},
+		{
+			name:       "quoted header and value with spaces and operators",
+			expression: `"first name" != 'a <= b'`,
+			want:       []filterToken{{filterQuoted, "first name"}, {filterOperator, "!="}, {filterQuoted, "a <= b"}},
+		},
+		{
+			name:       "doubled quote inside a quoted string",
+			expression: `title = "say ""hi""" OR title = 'it''s'`,
+			want: []filterToken{
+				{filterWord, "title"}, {filterOperator, "="}, {filterQuoted, `say "hi"`},
+				{filterWord, "OR"},
+				{filterWord, "title"}, {filterOperator, "="}, {filterQuoted, "it's"},
+			},
+		},
+		{
+			name:       "empty quoted string",
+			expression: `name = ""`,
+			want:       []filterToken{{filterWord, "name"}, {filterOperator, "="}, {filterQuoted, ""}},
+		},
+		{
+			name:       "parentheses",
+			expression: "(a<1)",
+			want:       []filterToken{{filterOpenParen, "("}, {filterWord, "a"}, {filterOperator, "<"}, {filterWord, "1"}, {filterCloseParen, ")"}},
+		},
+		{
+			name:       "unclosed quote",
+			expression: `name = "Ada`,
+			wantErr:    "filter has a quote that isn't closed",
+		},
+		{
+			name:       "lone exclamation mark",
+			expression: "name ! Ada",
+			wantErr:    "filter has a ! that isn't part of !=",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens, err := tokenizeFilter(test.expression)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("tokenizeFilter(%q) error = %v, want %q", test.expression, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tokenizeFilter(%q) error = %v", test.expression, err)
+			}
+			if !reflect.DeepEqual(tokens, test.want) {
+				t.Errorf("tokenizeFilter(%q) = %v, want %v", test.expression, tokens, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	columnHeaders := []string{"id", "datetime", "name", "age", "active", "first name"}
+
+	tests := []struct {
+		name       string
+		expression string
+		want       filterExpression
+		wantErr    string
+	}{
+		{
+			name:       "number value",
+			expression: "age >= 30",
+			want:       filterComparison{field: "age", operator: ">=", value: 30.0},
+		},
+		{
+			name:       "boolean value",
+			expression: "active = TRUE",
+			want:       filterComparison{field: "active", operator: "=", value: true},
+		},
+		{
+			name:       "quoted number stays text",
+			expression: `name = "30"`,
+			want:       filterComparison{field: "name", operator: "=", value: "30"},
+		},
+		{
+			name:       "quoted boolean stays text",
+			expression: `name < "true"`,
+			want:       filterComparison{field: "name", operator: "<", value: "true"},
+		},
+		{
+			name:       "quoted header",
+			expression: `"first name" contains ada`,
+			want:       filterComparison{field: "first name", operator: "contains", value: "ada"},
+		},
+		{
+			name:       "AND binds tighter than OR",
+			expression: "name = a OR age = 1 and active = false",
+			want: filterOr{
+				filterComparison{field: "name", operator: "=", value: "a"},
+				filterAnd{
+					filterComparison{field: "age", operator: "=", value: 1.0},
+					filterComparison{field: "active", operator: "=", value: false},
+				},
+			},
+		},
+		{
+			name:       "parentheses group",
+			expression: "(name = a OR age = 1) AND active = false",
+			want: filterAnd{
+				filterOr{
+					filterComparison{field: "name", operator: "=", value: "a"},
+					filterComparison{field: "age", operator: "=", value: 1.0},
+				},
+				filterComparison{field: "active", operator: "=", value: false},
+			},
+		},
+		{
+			name:       "OR chains left to right",
+			expression: "age = 1 OR age = 2 OR age = 3",
+			want: filterOr{
+				filterOr{
+					filterComparison{field: "age", operator: "=", value: 1.0},
+					filterComparison{field: "age", operator: "=", value: 2.0},
+				},
+				filterComparison{field: "age", operator: "=", value: 3.0},
+			},
+		},
+		{
+			name:       "infinity isn't a number",
+			expression: "name = Inf",
+			want:       filterComparison{field: "name", operator: "=", value: "Inf"},
+		},
+		{
+			name:       "unknown header",
+			expression: "nmae = Ada",
+			wantErr:    `filter has "nmae", which isn't a column header of this sheet`,
+		},
+		{
+			name:       "unknown header after OR",
+			expression: "name = Ada OR agee > 3",
+			wantErr:    `filter has "agee", which isn't a column header of this sheet`,
+		},
+		{
+			name:       "headers are case sensitive",
+			expression: "Name = Ada",
+			wantErr:    `filter has "Name", which isn't a column header of this sheet`,
+		},
+		{
+			name:       "boolean with less than",
+			expression: "active < true",
+			wantErr:    `filter compares "active" with <, but true and false can only be compared with = or !=`,
+		},
+		{
+			name:       "boolean with contains",
+			expression: "active contains false",
+			wantErr:    `filter compares "active" with contains, but true and false can only be compared with = or !=`,
+		},
+		{
+			name:       "no operator",
+			expression: "name Ada",
+			wantErr:    `filter has no operator after "name"`,
+		},
+		{
+			name:       "no value",
+			expression: "name =",
+			wantErr:    `filter has no value after "name" =`,
+		},
+		{
+			name:       "unclosed parenthesis",
+			expression: "(name = Ada",
+			wantErr:    "filter has a ( that isn't closed",
+		},
+		{
+			name:       "extra closing parenthesis",
+			expression: "name = Ada)",
+			wantErr:    `filter has an unexpected ")"`,
+		},
+		{
+			name:       "missing AND",
+			expression: "name = Ada age = 3",
+			wantErr:    `filter has an unexpected "age"`,
+		},
+		{
+			name:       "ends after AND",
+			expression: "name = Ada AND",
+			wantErr:    "filter ends where a comparison was expected",
+		},
+		{
+			name:       "operator where a header was expected",
+			expression: "= Ada",
+			wantErr:    `filter has "=" where a column header was expected`,
+		},
+		{
+			name:       "empty",
+			expression: "   ",
+			wantErr:    "filter is empty",
+		},
+		{
+			name:       "too long",
+			expression: strings.Repeat(" ", MAX_FILTER_LENGTH+1),
+			wantErr:    "filter can be at most 2000 characters",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parseFilter(test.expression, columnHeaders)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("parseFilter(%q) error = %v, want %q", test.expression, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFilter(%q) error = %v", test.expression, err)
+			}
+			if !reflect.DeepEqual(parsed, test.want) {
+				t.Errorf("parseFilter(%q) = %#v, want %#v", test.expression, parsed, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	columnHeaders := []string{"id", "datetime", "name", "age", "active"}
+	object := map[string]any{"id": "1", "datetime": "", "name": "Ada Lovelace", "age": 36.0, "active": "TRUE"}
+
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{"age = 36", true},
+		{"age > 36", false},
+		{"age != 36", false},
+		{`name contains "LOVE"`, true},
+		{"name < B", true},
+		{"active = true", true},
+		{"active != true", false},
+		{"active = false", false},
+		{"name = x OR age = 36 AND active = true", true},
+		{"(name = x OR age = 36) AND active = false", false},
+		{"name = 36", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			filter, err := parseFilter(test.expression, columnHeaders)
+			if err != nil {
+				t.Fatalf("parseFilter(%q) error = %v", test.expression, err)
+			}
+			if got := filter.matches(object); got != test.want {
+				t.Errorf("%q matches = %v, want %v", test.expression, got, test.want)
+			}
+		})
+	}
+}
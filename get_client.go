@@ -2,45 +2,198 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 )
 
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
+// Ways the server can authenticate with Google
+const AUTH_MODE_OAUTH = "oauth"
+const AUTH_MODE_SERVICE_ACCOUNT = "service-account"
+const AUTH_MODE_ADC = "adc"
+
+/*
+Builds the token source behind the HTTP client used for the Sheets and Drive services.
+  - oauth: a user's token from the token file, saved by `auth login` with the credentials file's client
+  - service-account: a service account's JSON key file. Note that a service account has its own Drive, so spreadsheets
+    need to be shared with its email address
+  - adc: application default credentials (GOOGLE_APPLICATION_CREDENTIALS, gcloud auth application-default login, or the
+    metadata server when running on GCP)
+*/
+func newGoogleTokenSource(ctx context.Context, settings *Config) (oauth2.TokenSource, error) {
+	switch settings.AuthMode {
+	case AUTH_MODE_OAUTH:
+		config, err := readOAuthConfig(settings.CredentialsFile, settings.Scopes)
+		if err != nil {
+			return nil, err
+		}
+		return getTokenSource(ctx, config, settings.TokenFile)
+
+	case AUTH_MODE_SERVICE_ACCOUNT:
+		if settings.ServiceAccountKey == "" {
+			return nil, fmt.Errorf("A service account key file is required for the %s auth mode", AUTH_MODE_SERVICE_ACCOUNT)
+		}
+		b, err := os.ReadFile(settings.ServiceAccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read service account key file: %v", err)
+		}
+
+		jwtConfig, err := google.JWTConfigFromJSON(b, settings.Scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse service account key file: %v", err)
+		}
+		return newTrackingTokenSource(jwtConfig.TokenSource(ctx), "", nil), nil
+
+	case AUTH_MODE_ADC:
+		credentials, err := google.FindDefaultCredentials(ctx, settings.Scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find application default credentials: %v", err)
+		}
+		return newTrackingTokenSource(credentials.TokenSource, "", nil), nil
+
+	default:
+		return nil, fmt.Errorf("Unknown auth mode %s, must be one of %s, %s or %s", settings.AuthMode, AUTH_MODE_OAUTH, AUTH_MODE_SERVICE_ACCOUNT, AUTH_MODE_ADC)
+	}
+}
+
+// How long `auth login` waits for the browser to come back with an authorization code
+const LOGIN_TIMEOUT = 5 * time.Minute
+
+/*
+Retrieves the token saved by `auth login`, then returns a token source that refreshes it when it expires and saves the
+refreshed token back to the same file. The token file stores the user's access and refresh tokens.
+*/
+func getTokenSource(ctx context.Context, config *oauth2.Config, tokenFile string) (oauth2.TokenSource, error) {
+	tok, err := tokenFromFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s (%v), sign in first with `go run . auth login`", tokenFile, err)
+	}
+	return newTrackingTokenSource(config.TokenSource(ctx, tok), tokenFile, tok), nil
+}
+
+func readOAuthConfig(credentialsFile string, scopes []string) (*oauth2.Config, error) {
+	b, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read client secret file: %v", err)
+	}
+
+	// If modifying these scopes, delete your previously saved token file.
+	config, err := google.ConfigFromJSON(b, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse client secret file to config: %v", err)
+	}
+	return config, nil
+}
+
+/*
+The `auth login` command. Signs the user in through their browser and saves their token to the token file. It takes the
+same flags as the server, e.g. `go run . auth login -credentials other.json`.
+*/
+func runAuthLogin(args []string) {
+	var err error
+	serverConfig, err = loadConfig(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config, err := readOAuthConfig(serverConfig.CredentialsFile, serverConfig.Scopes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tok, err := getTokenFromLoopback(config)
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+		log.Fatalf("Unable to sign in: %v", err)
 	}
-	return config.Client(context.Background(), tok)
+	saveToken(serverConfig.TokenFile, tok)
 }
 
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
+/*
+Requests a token from the web using a loopback redirect: a temporary server on a random local port receives the
+authorization code from Google, so nothing needs to be copied out of the browser. The state is random to block CSRF, and
+PKCE makes sure only this process can exchange the code for a token.
+*/
+func getTokenFromLoopback(config *oauth2.Config) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start local listener for the OAuth redirect: %v", err)
+	}
+	defer listener.Close()
+
+	loopbackConfig := *config
+	loopbackConfig.RedirectURL = fmt.Sprintf("http://127.0.0.1:%d/", listener.Addr().(*net.TCPAddr).Port)
+
+	stateBytes := make([]byte, 32)
+	if _, err := rand.Read(stateBytes); err != nil {
+		return nil, err
+	}
+	state := base64.RawURLEncoding.EncodeToString(stateBytes)
+	verifier := oauth2.GenerateVerifier()
+
+	type loginResult struct {
+		code string
+		err  error
+	}
+	results := make(chan loginResult, 1)
+
+	loginServer := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			queryParams := r.URL.Query()
+			var result loginResult
+			switch {
+			case queryParams.Get("state") != state:
+				// Not our redirect (or a forged one), so keep waiting for the real one
+				http.Error(w, "Invalid state", http.StatusBadRequest)
+				return
+			case queryParams.Get("error") != "":
+				http.Error(w, "Sign in failed: "+queryParams.Get("error"), http.StatusBadRequest)
+				result = loginResult{err: fmt.Errorf("authorization was denied: %s", queryParams.Get("error"))}
+			case queryParams.Get("code") == "":
+				http.Error(w, "Missing authorization code", http.StatusBadRequest)
+				result = loginResult{err: fmt.Errorf("redirect had no authorization code")}
+			default:
+				fmt.Fprintln(w, "Signed in, you can close this window.")
+				result = loginResult{code: queryParams.Get("code")}
+			}
+
+			// Only the first redirect counts, e.g. if the browser reloads the page
+			select {
+			case results <- result:
+			default:
+			}
+		}),
+	}
+	go loginServer.Serve(listener)
+	defer loginServer.Close()
+
+	authURL := loopbackConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	fmt.Printf("Go to the following link in your browser to sign in: \n%v\n", authURL)
 
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
+	var result loginResult
+	select {
+	case result = <-results:
+	case <-time.After(LOGIN_TIMEOUT):
+		return nil, fmt.Errorf("timed out after %v waiting for the browser", LOGIN_TIMEOUT)
+	}
+	if result.err != nil {
+		return nil, result.err
 	}
 
-	tok, err := config.Exchange(context.TODO(), authCode)
+	tok, err := loopbackConfig.Exchange(context.TODO(), result.code, oauth2.VerifierOption(verifier))
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+		return nil, fmt.Errorf("Unable to retrieve token from web: %v", err)
 	}
-	return tok
+	return tok, nil
 }
 
 // Retrieves a token from a local file.
@@ -58,10 +211,17 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 // Saves a token to a file path.
 func saveToken(path string, token *oauth2.Token) {
 	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	err := writeTokenFile(path, token)
 	if err != nil {
 		log.Fatalf("Unable to cache oauth token: %v", err)
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+}
+
+// Tokens are written atomically, since the server rewrites the token file whenever it refreshes the access token
+func writeTokenFile(path string, token *oauth2.Token) error {
+	tokenBytes, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, tokenBytes, 0600)
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/api/sheets/v4"
+)
+
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+
+// Set on a response that's a replay of an earlier request with the same idempotency key or object ID
+const IDEMPOTENT_REPLAYED_HEADER = "Idempotent-Replayed"
+
+// How long the response for an idempotency key is kept in memory. After that (or after a restart) a retry is still
+// caught, by finding its object ID in the sheet.
+const IDEMPOTENCY_KEY_TTL = 24 * time.Hour
+
+// Expired keys are dropped when they're looked up, and the rest are swept out at most this often
+const IDEMPOTENCY_SWEEP_INTERVAL = time.Hour
+
+// Object IDs for idempotency keys are derived in this namespace, so the same key always gives the same object ID
+var idempotencyNamespace = uuid.MustParse("5b1e1e9c-1f36-4c35-a0c6-6a3a8f4c2d11")
+
+/*
+Derives the object ID for an idempotency key. It's scoped to the sheet, so two clients that happen to pick the same key
+for different sheets don't collide, and it's a UUID like every other object ID.
+*/
+func objectIdForIdempotencyKey(spreadsheetId string, sheetId int64, idempotencyKey string) string {
+	return uuid.NewSHA1(idempotencyNamespace, []byte(fmt.Sprintf("%s/%d/%s", spreadsheetId, sheetId, idempotencyKey))).String()
+}
+
+// Hashes the parts of a request that have to match for it to count as a retry of an earlier one
+func hashIdempotentRequest(parts ...any) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		partBytes, _ := json.Marshal(part)
+		compactedBytes := new(bytes.Buffer)
+		if json.Compact(compactedBytes, partBytes) == nil {
+			partBytes = compactedBytes.Bytes()
+		}
+		hash.Write(partBytes)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+type idempotentResult struct {
+	requestHash string
+	// Nil while the first request with the key is still being handled
+	responseBody map[string]any
+	status       int
+	storedAt     time.Time
+}
+
+func (result *idempotentResult) expired() bool {
+	return result.responseBody != nil && time.Since(result.storedAt) > IDEMPOTENCY_KEY_TTL
+}
+
+/*
+Remembers the response to each request that had an idempotency key, so a retry gets the same response back instead of
+adding the object again.
+*/
+type idempotencyStore struct {
+	mu        sync.Mutex
+	results   map[string]*idempotentResult
+	lastSwept time.Time
+}
+
+var idempotencyKeys = &idempotencyStore{results: make(map[string]*idempotentResult)}
+
+/*
+Claims the key for a request. If an earlier request with the key has finished, its result is returned to be replayed.
+inProgress is true if a request with the key is still being handled, and mismatch is true if the key was used before
+for a different request.
+*/
+func (store *idempotencyStore) begin(idempotencyKey string, requestHash string) (result *idempotentResult, inProgress bool, mismatch bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// Sweeping on every request would go through every stored key while holding the lock
+	if time.Since(store.lastSwept) > IDEMPOTENCY_SWEEP_INTERVAL {
+		for key, storedResult := range store.results {
+			if storedResult.expired() {
+				delete(store.results, key)
+			}
+		}
+		store.lastSwept = time.Now()
+	}
+
+	storedResult := store.results[idempotencyKey]
+	if storedResult != nil && storedResult.expired() {
+		delete(store.results, idempotencyKey)
+		storedResult = nil
+	}
+	switch {
+	case storedResult == nil:
+		store.results[idempotencyKey] = &idempotentResult{requestHash: requestHash}
+		return nil, false, false
+	case storedResult.requestHash != requestHash:
+		return nil, false, true
+	case storedResult.responseBody == nil:
+		return nil, true, false
+	default:
+		return storedResult, false, false
+	}
+}
+
+func (store *idempotencyStore) finish(idempotencyKey string, status int, responseBody map[string]any) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if storedResult := store.results[idempotencyKey]; storedResult != nil {
+		storedResult.status = status
+		storedResult.responseBody = responseBody
+		storedResult.storedAt = time.Now()
+	}
+}
+
+// Releases a key whose request failed, so that it can be retried
+func (store *idempotencyStore) abandon(idempotencyKey string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if storedResult := store.results[idempotencyKey]; storedResult != nil && storedResult.responseBody == nil {
+		delete(store.results, idempotencyKey)
+	}
+}
+
+/*
+Appends objects' rows with one BatchUpdate, retrying quota and server errors. Appends aren't retried by the retry
+transport because a lost response would add the rows twice, but with the objects' IDs known up front the sheet can be
+checked for them before each retry, in case the earlier attempt went through after all. A BatchUpdate is applied whole
+or not at all, so finding the first object is enough.
+*/
+func appendObjectsWithRetries(ctx context.Context, spreadsheetId string, sheetTitle string, objectIds []string, appendRequests []*sheets.Request) error {
+	deadline := retryDeadline(ctx, time.Duration(serverConfig.RetryMaxElapsed))
+	var retryBackoff backoff
+
+	for attempt := 1; ; attempt++ {
+		err := batchUpdateObjects(ctx, spreadsheetId, appendRequests)
+		if err == nil {
+			sheetStructureCache.objectsAppended(spreadsheetId, sheetTitle, objectIds...)
+			return nil
+		}
+		if !isRetryableGoogleError(ctx, err) {
+			return err
+		}
+
+		wait := max(retryBackoff.next(), googleRetryAfter(err))
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		log.Printf("Retrying append of %d object(s) starting with %s in %v after %v (attempt %d)", len(objectIds), objectIds[0], wait, err, attempt)
+		if sleepErr := sleepContext(ctx, wait); sleepErr != nil {
+			return err
+		}
+
+		// Reading the sheet again also brings the cache up to date if the rows are there
+		sheetStructureCache.invalidate(spreadsheetId, sheetTitle)
+		_, _, _, found, lookupErr := readObjectRow(ctx, spreadsheetId, sheetTitle, objectIds[0])
+		if lookupErr == nil && found {
+			return nil
+		}
+	}
+}
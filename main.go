@@ -1,20 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"slices"
+	"syscall"
 	"time"
 
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 
 	// Sheets API
@@ -24,29 +23,37 @@ import (
 	"google.golang.org/api/drive/v3"
 
 	"github.com/google/uuid"
+	"golang.org/x/oauth2"
 )
 
 var sheetsService *sheets.Service
 var driveService *drive.Service
-
-const DEFAULT_FILE_PERMISSIONS = 0644
-
-var SCOPES []string = []string{"https://www.googleapis.com/auth/spreadsheets", "https://www.googleapis.com/auth/drive"}
+var spreadsheetRegistry Registry
+var googleTokenSource oauth2.TokenSource
 
 func main() {
 
-	ctx := context.Background()
-	b, err := os.ReadFile("credentials.json")
+	// `auth login` signs in and exits, rather than starting the server
+	if len(os.Args) >= 3 && os.Args[1] == "auth" && os.Args[2] == "login" {
+		runAuthLogin(os.Args[3:])
+		return
+	}
+
+	var err error
+	serverConfig, err = loadConfig(os.Args[1:])
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+		log.Fatal(err)
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, SCOPES...)
+	ctx := context.Background()
+	googleTokenSource, err = newGoogleTokenSource(ctx, serverConfig)
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		log.Fatalf("Unable to authenticate with Google: %v", err)
+	}
+	oauthClient := oauth2.NewClient(ctx, googleTokenSource)
+	client := &http.Client{
+		Transport: newRetryTransport(oauthClient.Transport, time.Duration(serverConfig.GoogleAPITimeout), time.Duration(serverConfig.RetryMaxElapsed)),
 	}
-	client := getClient(config)
 
 	sheetsService, err = sheets.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
@@ -58,100 +65,287 @@ func main() {
 		log.Fatalf("Unable to retrieve Drive client: %v", err)
 	}
 
+	sheetStructureCache = newSheetCache(time.Duration(serverConfig.CacheTTL))
+
+	spreadsheetRegistry, err = newRegistry(serverConfig.RegistryBackend, serverConfig.RegistryPath, os.FileMode(serverConfig.FilePermissions))
+	if err != nil {
+		log.Fatalf("Unable to open spreadsheet registry: %v", err)
+	}
+
 	// It's essential to understand Google's distinction between the term Spreadsheet (A Sheets document) and Sheet (an individual sheet, of which a spreadsheet may contain many). It may be helpful to think of a spreadsheet as a DB and a sheet as a table.
 
 	// GET endpoints
+	http.HandleFunc("GET /health", health)
 	http.HandleFunc("GET /readSpreadsheetMetaData", readSpreadsheetMetaData)
 	http.HandleFunc("GET /readSheetData", readSheetData)
+	http.HandleFunc("GET /readObject", readObject)
+	http.HandleFunc("GET /listSpreadsheets", listSpreadsheetsHandler)
+	http.HandleFunc("GET /debug/config", debugConfig)
 
 	// POST endpoints
 	http.HandleFunc("POST /createSpreadsheet", createSpreadsheet)
 	http.HandleFunc("POST /createSheet", createSheet)
 	http.HandleFunc("POST /addObjectToSheet", addObjectToSheet)
+	http.HandleFunc("POST /addObjectsToSheet", addObjectsToSheet)
+
+	// PUT endpoints
+	http.HandleFunc("PUT /updateObject", updateObject)
 
 	// DELETE endpoints
 	http.HandleFunc("DELETE /deleteObject", deleteObject)
+	// Takes a request body, which not every client or proxy will send with a DELETE
+	http.HandleFunc("POST /deleteObjects", deleteObjects)
+
+	server := &http.Server{
+		Addr:         serverConfig.ListenAddress,
+		Handler:      withRequestId(http.DefaultServeMux),
+		ReadTimeout:  time.Duration(serverConfig.ReadTimeout),
+		WriteTimeout: time.Duration(serverConfig.WriteTimeout),
+	}
+
+	// SIGINT or SIGTERM stops the server from taking new connections, then waits for in-flight requests to finish
+	shutdownCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	fmt.Println("Starting server . . .")
-	err = http.ListenAndServe("127.0.0.1:3333", nil)
+	serverErrors := make(chan error, 1)
+	go func() {
+		fmt.Printf("Starting server on %s . . .\n", serverConfig.ListenAddress)
+		serverErrors <- server.ListenAndServe()
+	}()
 
-	if errors.Is(err, http.ErrServerClosed) {
-		fmt.Printf("server closed\n")
-	} else if err != nil {
+	select {
+	case err = <-serverErrors:
 		fmt.Printf("error starting server: %s\n", err)
 		os.Exit(1)
+	case <-shutdownCtx.Done():
 	}
-}
+	// Stop catching signals, so a second Ctrl-C kills the server without waiting
+	stop()
 
-func readSheetData(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Shutting down, waiting up to %v for in-flight requests . . .\n", time.Duration(serverConfig.ShutdownTimeout))
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(serverConfig.ShutdownTimeout))
+	defer cancel()
 
-	u, err := url.Parse(r.URL.String())
+	err = server.Shutdown(drainCtx)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Printf("error shutting down server: %s\n", err)
+		os.Exit(1)
+	}
+
+	err = spreadsheetRegistry.Close()
+	if err != nil {
+		fmt.Printf("error closing spreadsheet registry: %s\n", err)
+	}
+	fmt.Printf("server closed\n")
+}
+
+/*
+Reports whether Google is still accepting our credentials. When a refresh token has been revoked or has expired this
+responds 503 with reauthentication_required, and every Google call fails the same way until someone signs in again.
+*/
+func health(w http.ResponseWriter, r *http.Request) {
+
+	// Asking for a token refreshes it if it has expired, which updates the auth status
+	googleTokenSource.Token()
+
+	reauthenticationRequired, lastError, since := googleAuthStatus.get()
+	if reauthenticationRequired {
+		writeErrorDetails(w, r, http.StatusServiceUnavailable, ErrorDetails{
+			Code:    "reauthentication_required",
+			Message: fmt.Sprintf("Google has rejected our credentials since %s, sign in again with `go run . auth login`: %s", since.Format(time.RFC3339), lastError),
+		})
 		return
 	}
 
-	queryParams := u.Query()
+	var responseBody map[string]any = make(map[string]any)
+
+	responseBody["Status"] = "ok"
+
+	writeJSON(w, r, http.StatusOK, responseBody)
+}
+
+func readSheetData(w http.ResponseWriter, r *http.Request) {
+
+	queryParams := r.URL.Query()
 
 	spreadsheetTitle := queryParams.Get("spreadsheetTitle")
 	sheetTitle := queryParams.Get("sheetTitle")
 
-	spreadsheetId := getSpreadsheetId(spreadsheetTitle)
-	spreadsheetToRead, err := sheetsService.Spreadsheets.Get(spreadsheetId).Do(googleapi.QueryParameter("includeGridData", "true"))
+	limit, err := parsePageLimit(queryParams.Get("limit"))
 	if err != nil {
-		log.Fatalf("Unable to get spreadsheet from sheets service: %v", err)
+		writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return
 	}
 
-	columnHeaders, sheetData, err := readNRowsFromSheetByTitle(10, sheetTitle, spreadsheetToRead)
+	cursor, err := decodeCursor(queryParams.Get("cursor"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
 
+	// A cursor only makes sense in the order it came from
+	sortParam := queryParams.Get("sort")
+	if cursor != nil && cursor.Sort != sortParam {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "cursor is from a request with a different sort")
+		return
+	}
+
+	spreadsheetId, err := getSpreadsheetId(r.Context(), spreadsheetTitle)
 	if err != nil {
-		log.Fatalf("Error while reading rows from sheet: %v", err)
+		writeSpreadsheetLookupError(w, r, spreadsheetTitle, err)
+		return
 	}
 
-	if columnHeaders == nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Unable to find requested sheet " + sheetTitle + " in " + spreadsheetTitle))
+	var columnHeaders []string
+	var pageRows []sheetPageRow
+	var nextCursor string
+	if sortParam == "" {
+		columnHeaders, pageRows, nextCursor, err = readPageFromSheetByTitle(r.Context(), limit, cursor, queryParams.Get("filter"), spreadsheetId, sheetTitle)
+	} else {
+		columnHeaders, pageRows, nextCursor, err = readSortedPageFromSheet(r.Context(), limit, cursor, queryParams.Get("filter"), sortParam, spreadsheetId, sheetTitle)
+	}
+
+	if err != nil {
+		writeSheetReadError(w, r, spreadsheetTitle, sheetTitle, err)
+		return
+	}
+
+	if fieldsParam := queryParams.Get("fields"); fieldsParam != "" {
+		columnHeaders, err = parseFields(fieldsParam, columnHeaders)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_fields", err.Error())
+			return
+		}
+		for index := range pageRows {
+			pageRows[index].object = projectObject(pageRows[index].object, columnHeaders)
+		}
 	}
 
 	var responseBody map[string]any = make(map[string]any)
 
 	responseBody["ColumnHeaders"] = columnHeaders
-	responseBody["SheetData"] = sheetData
+	if serverConfig.LegacySheetData {
+		// The original shape, which JSON puts in key order, so Row10 comes before Row2
+		var sheetData map[string]map[string]any = make(map[string]map[string]any)
+		for _, pageRow := range pageRows {
+			sheetData[fmt.Sprintf("Row%v", pageRow.rowIndex)] = pageRow.object
+		}
+		responseBody["SheetData"] = sheetData
+	} else {
+		var rows []map[string]any = make([]map[string]any, 0)
+		for _, pageRow := range pageRows {
+			rows = append(rows, pageRow.object)
+		}
+		responseBody["Rows"] = rows
+	}
+	responseBody["NextCursor"] = nextCursor
+
+	writeJSON(w, r, http.StatusOK, responseBody)
+}
 
-	responseBodyBytes, err := json.Marshal(responseBody)
+func readObject(w http.ResponseWriter, r *http.Request) {
+
+	queryParams := r.URL.Query()
+
+	spreadsheetTitle := queryParams.Get("spreadsheetTitle")
+	sheetTitle := queryParams.Get("sheetTitle")
+	objectId := queryParams.Get("objectId")
+
+	spreadsheetId, err := getSpreadsheetId(r.Context(), spreadsheetTitle)
+	if err != nil {
+		writeSpreadsheetLookupError(w, r, spreadsheetTitle, err)
+		return
+	}
+	// Only the object's own row is read, the cache knows which row it's in
+	cached, _, row, found, err := readObjectRow(r.Context(), spreadsheetId, sheetTitle, objectId)
 	if err != nil {
-		log.Fatalf("Error turning response body to JSON bytes. Error: %v", err)
+		writeSheetReadError(w, r, spreadsheetTitle, sheetTitle, err)
+		return
+	}
+
+	if !found {
+		writeError(w, r, http.StatusNotFound, "object_not_found", "Object not found: "+objectId)
+		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(responseBodyBytes)
 
+	var responseBody map[string]any = make(map[string]any)
+
+	responseBody["Object"] = rowToObject(getColumnHeaders(cached.sheet), row)
+	responseBody["SheetUrl"] = buildSpreadsheetUrl(spreadsheetId, cached.sheet.Properties.SheetId)
+
+	writeJSON(w, r, http.StatusOK, responseBody)
 }
 
-func readSpreadsheetMetaData(w http.ResponseWriter, r *http.Request) {
+func listSpreadsheetsHandler(w http.ResponseWriter, r *http.Request) {
+
+	queryParams := r.URL.Query()
+
+	pageSize, err := parsePageLimit(queryParams.Get("pageSize"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
 
-	u, err := url.Parse(r.URL.String())
+	spreadsheetList, nextPageToken, err := listSpreadsheets(r.Context(), pageSize, queryParams.Get("pageToken"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeGoogleError(w, r, err, "Error while listing spreadsheets")
 		return
 	}
 
-	queryParams := u.Query()
+	var responseBody map[string]any = make(map[string]any)
+
+	responseBody["Spreadsheets"] = spreadsheetList
+	responseBody["NextPageToken"] = nextPageToken
+
+	writeJSON(w, r, http.StatusOK, responseBody)
+}
+
+func readSpreadsheetMetaData(w http.ResponseWriter, r *http.Request) {
+
+	queryParams := r.URL.Query()
 
 	var spreadsheetTitle string = queryParams.Get("title")
 
-	spreadsheetId := getSpreadsheetId(spreadsheetTitle)
+	spreadsheetId, err := getSpreadsheetId(r.Context(), spreadsheetTitle)
+	if err != nil {
+		writeSpreadsheetLookupError(w, r, spreadsheetTitle, err)
+		return
+	}
 
-	spreadsheetToRead, err := sheetsService.Spreadsheets.Get(spreadsheetId).Do(googleapi.QueryParameter("includeGridData", "true"))
+	spreadsheetToRead, err := sheetsService.Spreadsheets.Get(spreadsheetId).
+		Fields("spreadsheetId,properties.title,sheets.properties.title").
+		Context(r.Context()).
+		Do()
 	if err != nil {
-		log.Fatalf("Unable to get spreadsheet from sheets service: %v", err)
+		writeGoogleError(w, r, err, "Unable to get spreadsheet from sheets service")
+		return
 	}
 
-	var sheetTitles map[string][]string = make(map[string][]string)
+	// Then just the header row of each sheet
+	var headerRanges []string
 	for _, sheet := range spreadsheetToRead.Sheets {
-		sheetTitles[sheet.Properties.Title] = []string{}
-		for _, columnHeaders := range sheet.Data[0].RowData[0].Values {
-			sheetTitles[sheet.Properties.Title] = append(sheetTitles[sheet.Properties.Title], columnHeaders.FormattedValue)
+		headerRanges = append(headerRanges, sheetRange(sheet.Properties.Title, "1:1"))
+	}
+	headerValues, err := sheetsService.Spreadsheets.Values.BatchGet(spreadsheetId).
+		Ranges(headerRanges...).
+		Fields("valueRanges.values").
+		Context(r.Context()).
+		Do()
+	if err != nil {
+		writeGoogleError(w, r, err, "Unable to get column headers from sheets service")
+		return
+	}
+
+	var sheetTitles map[string][]string = make(map[string][]string)
+	for sheetIndex, sheet := range spreadsheetToRead.Sheets {
+		// A sheet with no header row should still be listed with no headers
+		var columnHeaders []string = make([]string, 0)
+		if sheetIndex < len(headerValues.ValueRanges) && len(headerValues.ValueRanges[sheetIndex].Values) > 0 {
+			for _, header := range headerValues.ValueRanges[sheetIndex].Values[0] {
+				columnHeaders = append(columnHeaders, fmt.Sprint(header))
+			}
 		}
+		sheetTitles[sheet.Properties.Title] = columnHeaders
 	}
 
 	var responseBody map[string]any = make(map[string]any)
@@ -160,78 +354,63 @@ func readSpreadsheetMetaData(w http.ResponseWriter, r *http.Request) {
 	responseBody["SpreadsheetID"] = spreadsheetToRead.SpreadsheetId
 	responseBody["SheetTitlesWithColumnHeaders"] = sheetTitles
 
-	responseBodyBytes, err := json.Marshal(responseBody)
-	if err != nil {
-		log.Fatalf("Error turning response body to JSON bytes. Error: %v", err)
-	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(responseBodyBytes)
-
+	writeJSON(w, r, http.StatusOK, responseBody)
 }
 
 func deleteObject(w http.ResponseWriter, r *http.Request) {
-	u, err := url.Parse(r.URL.String())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 
-	queryParams := u.Query()
+	queryParams := r.URL.Query()
 
 	objectToDeleteId := queryParams.Get("objectId")
 	spreadsheetTitle := queryParams.Get("spreadsheetTitle")
 	sheetTitle := queryParams.Get("sheetTitle")
 
-	spreadsheetId := getSpreadsheetId(spreadsheetTitle)
-	spreadsheet, err := sheetsService.Spreadsheets.Get(spreadsheetId).Do(googleapi.QueryParameter("includeGridData", "true"))
+	spreadsheetId, err := getSpreadsheetId(r.Context(), spreadsheetTitle)
 	if err != nil {
-		log.Fatalf("Unable to get spreadsheet from sheets service: %v", err)
+		writeSpreadsheetLookupError(w, r, spreadsheetTitle, err)
+		return
 	}
+	// The cache knows which row the object is in, and reading that one row checks it's still there
+	unlock := rowIndexLocks.lock(spreadsheetId)
+	defer unlock()
+	cached, rowIndexToDelete, _, found, err := readObjectRow(r.Context(), spreadsheetId, sheetTitle, objectToDeleteId)
+	if err != nil {
+		writeSheetReadError(w, r, spreadsheetTitle, sheetTitle, err)
+		return
+	}
+	sheetId := cached.sheet.Properties.SheetId
 
-	rowIndexToDelete := findRowIndexByObjectId(objectToDeleteId, sheetTitle, spreadsheet)
-	sheetId := getSheetId(sheetTitle, spreadsheet)
-
-	// We check for 0 because this should always be the "id" column header, and 0 is initialized. In other words, if this is 0, then no object was found
-	if (rowIndexToDelete == 0) {
-		log.Printf("Object not found: %s", objectToDeleteId)
+	if !found {
+		writeError(w, r, http.StatusNotFound, "object_not_found", "Object not found: "+objectToDeleteId)
+		return
 	}
 
-	_, err = sheetsService.Spreadsheets.BatchUpdate(spreadsheetId,
-		&sheets.BatchUpdateSpreadsheetRequest{
-			IncludeSpreadsheetInResponse: false,
-			Requests: []*sheets.Request{
-				{
-					DeleteRange: &sheets.DeleteRangeRequest{
-						Range: &sheets.GridRange{
-							StartRowIndex: rowIndexToDelete,
-							EndRowIndex: rowIndexToDelete + 1,
-							SheetId: sheetId,
-						},
-						ShiftDimension: "ROWS",
+	err = batchUpdateObjects(r.Context(), spreadsheetId,
+		[]*sheets.Request{
+			{
+				DeleteRange: &sheets.DeleteRangeRequest{
+					Range: &sheets.GridRange{
+						StartRowIndex: rowIndexToDelete,
+						EndRowIndex:   rowIndexToDelete + 1,
+						SheetId:       sheetId,
 					},
+					ShiftDimension: "ROWS",
 				},
 			},
 		},
-	).Do()
+	)
 
-	if (err != nil) {
-		fmt.Printf("Error while trying to delete object from sheet: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(string("Error while trying to delete object from sheet")))
+	if err != nil {
+		writeMutationError(w, r, err, "Error while trying to delete object from sheet")
 		return
 	}
+	sheetStructureCache.rowsDeleted(spreadsheetId, sheetTitle, rowIndexToDelete)
 
 	var responseBody map[string]any = make(map[string]any)
 
 	responseBody["SheetUrl"] = buildSpreadsheetUrl(spreadsheetId, sheetId)
 
-	responseBodyBytes, err := json.Marshal(responseBody)
-	if err != nil {
-		log.Fatalf("Error turning response body to JSON bytes. Error: %v", err)
-	}
-	w.WriteHeader(http.StatusCreated)
-	w.Write(responseBodyBytes)
-
+	writeJSON(w, r, http.StatusCreated, responseBody)
 }
 
 type SpreadsheetCreationHttpRequest struct {
@@ -244,101 +423,84 @@ func createSpreadsheet(w http.ResponseWriter, r *http.Request) {
 	var requestBody SpreadsheetCreationHttpRequest
 	err := decoder.Decode(&requestBody)
 	if err != nil {
-		panic(err)
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Unable to unmarshal request body JSON. Error: "+err.Error())
+		return
 	}
 
 	var newTitle string = requestBody.Title
 
-	fileList, err := driveService.Files.List().Do()
+	// Drive does the name matching for us, and every page of matches is checked so duplicates can't hide past the first page
+	existingSpreadsheets, err := findSpreadsheetsByName(r.Context(), newTitle)
 	if err != nil {
-		log.Fatalf("Unable to perform query for drive files. Error: %v", err)
+		writeGoogleError(w, r, err, "Unable to check Drive for spreadsheets with the same title")
+		return
 	}
 
-	if len(fileList.Files) == 0 {
-
-		fmt.Println("No files found.")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Could not find any files in the drive"))
+	if len(existingSpreadsheets) > 0 {
+		fmt.Printf("%s (%s)\n", existingSpreadsheets[0].Name, existingSpreadsheets[0].Id)
+		fmt.Println("Request received with sheet title already exists (Status 409)")
+		writeError(w, r, http.StatusConflict, "spreadsheet_already_exists", "Sheet title already exists, please choose another")
 		return
-
 	}
 
-	for _, i := range fileList.Files {
-		if i.Name == newTitle {
-			fmt.Printf("%s (%s)\n", i.Name, i.Id)
-			fmt.Println("Request received with sheet title already exists (Status 409)")
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte("Sheet title already exists, please choose another"))
-			return
-		}
+	newSpreadsheet, err := sheetsService.Spreadsheets.Create(&sheets.Spreadsheet{Properties: &sheets.SpreadsheetProperties{Title: newTitle}}).Context(r.Context()).Do()
+	if err != nil {
+		writeGoogleError(w, r, err, "Unable to create new spreadsheet with title "+newTitle)
+		return
 	}
 
-	newSpreadsheet, err := sheetsService.Spreadsheets.Create(&sheets.Spreadsheet{Properties: &sheets.SpreadsheetProperties{Title: newTitle}}).Do()
+	// Add new Spreadsheet title/ID pair to the registry
+	err = spreadsheetRegistry.Register(newSpreadsheet.Properties.Title, newSpreadsheet.SpreadsheetId)
 	if err != nil {
-		log.Fatalf("Unable to create new sheet with title: %s. Error: %v", newTitle, err)
+		writeError(w, r, http.StatusInternalServerError, "registry_error", fmt.Sprintf("Spreadsheet %s was created but couldn't be saved to the registry: %v", newSpreadsheet.SpreadsheetId, err))
+		return
 	}
 
-	if newSpreadsheet.Properties.Title != "" && newSpreadsheet.SpreadsheetId != "" {
-
-		// Add new Spreadsheet title/ID pair to data.json file
-		spreadsheetJsonFilePath := "data/spreadsheetIDs.json"
-		spreadsheetJsonFile, err := os.ReadFile(spreadsheetJsonFilePath)
-		if err != nil {
-			log.Fatalf("Unable to read Data Spreadsheet ID file: %v", err)
-		}
-
-		var spreadsheetIdObject map[string]string
-		err = json.Unmarshal(spreadsheetJsonFile, &spreadsheetIdObject)
-		if err != nil {
-			log.Fatalf("Unable to decode Data Spreadsheet ID JSON: %v", err)
-		}
-
-		spreadsheetIdObject[newSpreadsheet.Properties.Title] = newSpreadsheet.SpreadsheetId
-		dataBytes, err := json.Marshal((spreadsheetIdObject))
-		if err != nil {
-			log.Fatalf("Unable to encode Data Spreadsheet ID JSON: %v", err)
-		}
-
-		os.WriteFile(spreadsheetJsonFilePath, dataBytes, DEFAULT_FILE_PERMISSIONS)
-
-		var responseBody map[string]string = make(map[string]string)
+	var responseBody map[string]string = make(map[string]string)
 
-		responseBody["SpreadsheetID"] = newSpreadsheet.SpreadsheetId
-
-		responseBodyBytes, err := json.Marshal(responseBody)
-		if err != nil {
-			log.Fatalf("Error turning response body to JSON bytes. Error: %v", err)
-		}
-		w.WriteHeader(http.StatusCreated)
-		w.Write(responseBodyBytes)
-		return
-	}
+	responseBody["SpreadsheetID"] = newSpreadsheet.SpreadsheetId
 
+	writeJSON(w, r, http.StatusCreated, responseBody)
 }
 
 type SheetCreationHttpRequest struct {
 	SpreadsheetTitle      string
 	NewSheetTitle         string
 	NewSheetColumnHeaders []string
+	// Optional, used instead of NewSheetColumnHeaders to also give each column a type, default, etc.
+	NewSheetSchema SheetSchema
 }
 
 func createSheet(w http.ResponseWriter, r *http.Request) {
 
-	// This step is necessary so that we can get the request body as a byte array to pass to json.Unmarshal()
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Fatalf("Unable to parse request body. Error: %v", err)
-	}
-
 	requestBody := new(SheetCreationHttpRequest)
-	err = json.Unmarshal([]byte(body), &requestBody)
+	// UseNumber keeps schema defaults and enum values as json.Number, the same as values sent to addObjectToSheet
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	err := decoder.Decode(&requestBody)
 	if err != nil {
-		log.Fatalf("Unable to unmarshal request body JSON. Error: %v", err)
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Unable to unmarshal request body JSON. Error: "+err.Error())
+		return
 	}
 
 	var newSheetTitle string = requestBody.NewSheetTitle
 	var spreadsheetTitle string = requestBody.SpreadsheetTitle
 	var columnHeadersStrings []string = requestBody.NewSheetColumnHeaders
+	var schema SheetSchema = requestBody.NewSheetSchema
+
+	if len(schema) > 0 {
+		if len(columnHeadersStrings) > 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", "Send either NewSheetColumnHeaders or NewSheetSchema, not both")
+			return
+		}
+
+		err = schema.validate()
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_schema", "Invalid schema: "+err.Error())
+			return
+		}
+		columnHeadersStrings = schema.columnNames()
+	}
 
 	var newColumnHeaders []*sheets.CellData = make([]*sheets.CellData, 0)
 
@@ -350,7 +512,11 @@ func createSheet(w http.ResponseWriter, r *http.Request) {
 		newColumnHeaders = append(newColumnHeaders, newHeader)
 	}
 
-	spreadsheetId := getSpreadsheetId(spreadsheetTitle)
+	spreadsheetId, err := getSpreadsheetId(r.Context(), spreadsheetTitle)
+	if err != nil {
+		writeSpreadsheetLookupError(w, r, spreadsheetTitle, err)
+		return
+	}
 
 	appendSheetResponse, err := sheetsService.Spreadsheets.BatchUpdate(spreadsheetId,
 		&sheets.BatchUpdateSpreadsheetRequest{
@@ -365,38 +531,49 @@ func createSheet(w http.ResponseWriter, r *http.Request) {
 				},
 			},
 		},
-	).Do()
+	).Context(r.Context()).Do()
 
 	if err != nil {
-		fmt.Printf("Error while trying to add sheet to spreadsheet: %v\n", err)
-		w.WriteHeader(http.StatusConflict)
-		w.Write([]byte("Error while trying to add sheet to spreadsheet"))
+		writeGoogleError(w, r, err, "Error while trying to add sheet to spreadsheet")
 		return
 	}
 
-	appendCellsResponse, err := sheetsService.Spreadsheets.BatchUpdate(spreadsheetId,
-		&sheets.BatchUpdateSpreadsheetRequest{
-			IncludeSpreadsheetInResponse: true,
-			Requests: []*sheets.Request{
-				{
-					AppendCells: &sheets.AppendCellsRequest{
-						Fields: "*",
-						Rows: []*sheets.RowData{
-							{
-								Values: newColumnHeaders,
-							},
-						},
-						SheetId: appendSheetResponse.Replies[0].AddSheet.Properties.SheetId,
+	newSheetId := appendSheetResponse.Replies[0].AddSheet.Properties.SheetId
+	// In case a sheet with the same title was cached before it was deleted
+	sheetStructureCache.invalidate(spreadsheetId, newSheetTitle)
+	headerRequests := []*sheets.Request{
+		{
+			AppendCells: &sheets.AppendCellsRequest{
+				Fields: "*",
+				Rows: []*sheets.RowData{
+					{
+						Values: newColumnHeaders,
 					},
 				},
+				SheetId: newSheetId,
 			},
 		},
-	).Do()
+	}
+
+	// The schema is saved on the header row so that addObjectToSheet can enforce it later
+	if len(schema) > 0 {
+		schemaRequest, err := newSchemaMetadataRequest(schema, newSheetId)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Unable to encode schema: "+err.Error())
+			return
+		}
+		headerRequests = append(headerRequests, schemaRequest)
+	}
+
+	appendCellsResponse, err := sheetsService.Spreadsheets.BatchUpdate(spreadsheetId,
+		&sheets.BatchUpdateSpreadsheetRequest{
+			IncludeSpreadsheetInResponse: true,
+			Requests:                     headerRequests,
+		},
+	).Context(r.Context()).Do()
 
 	if err != nil {
-		fmt.Printf("Error while trying to add sheet headers: %v\n", err)
-		w.WriteHeader(http.StatusConflict)
-		w.Write([]byte(string("Error while trying to add sheet headers")))
+		writeGoogleError(w, r, err, "Error while trying to add sheet headers")
 		return
 	}
 
@@ -407,200 +584,535 @@ func createSheet(w http.ResponseWriter, r *http.Request) {
 	responseBody["SpreadsheetUrl"] = buildSpreadsheetUrl(spreadsheetId, appendSheetResponse.Replies[0].AddSheet.Properties.SheetId)
 	// This isn't perfect because we're trusting that the data got applied rather than checking it, but it should be guaranteed to update with a non-error response, so good if not perfect. Not worth a third network call imo.
 	responseBody["ColumnHeaders"] = columnHeadersStrings
-
-	responseBodyBytes, err := json.Marshal(responseBody)
-	if err != nil {
-		log.Fatalf("Error turning response body to JSON bytes. Error: %v", err)
+	if len(schema) > 0 {
+		responseBody["Schema"] = schema
 	}
-	w.WriteHeader(http.StatusCreated)
-	w.Write(responseBodyBytes)
+
+	writeJSON(w, r, http.StatusCreated, responseBody)
 }
 
 type AddObjectToSheetRequest struct {
 	SpreadsheetTitle string
 	SheetTitle       string
-	NewObject        []string
+	// Either a JSON object keyed by column header, or (the original format) an array of values in column order
+	NewObject json.RawMessage
+	// Optional, a UUID for the new object. Sending the same ID again doesn't add the object twice.
+	ObjectId string
 }
 
 func addObjectToSheet(w http.ResponseWriter, r *http.Request) {
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Fatalf("Unable to parse request body. Error: %v", err)
-	}
-
 	requestBody := new(AddObjectToSheetRequest)
-	err = json.Unmarshal([]byte(body), &requestBody)
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
-		log.Fatalf("Unable to unmarshal request body JSON. Error: %v", err)
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Unable to unmarshal request body JSON. Error: "+err.Error())
+		return
 	}
 
 	var spreadsheetTitle string = requestBody.SpreadsheetTitle
 	var sheetTitle string = requestBody.SheetTitle
-	var newObject []string = requestBody.NewObject
+	var idempotencyKey string = r.Header.Get(IDEMPOTENCY_KEY_HEADER)
 
-	spreadsheetId := getSpreadsheetId(spreadsheetTitle)
-	spreadsheet, err := sheetsService.Spreadsheets.Get(spreadsheetId).Do(googleapi.QueryParameter("includeGridData", "true"))
-	if err != nil {
-		fmt.Printf("Unable to get spreadsheet from sheets service: %v", err)
-		w.WriteHeader(http.StatusNotFound)
-		w.Write(fmt.Appendf(nil, "Unable to get spreadsheet from sheets service: %v", err))
+	if requestBody.ObjectId != "" && uuid.Validate(requestBody.ObjectId) != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_object_id", "ObjectId must be a UUID")
 		return
 	}
 
-	sheetId := getSheetId(sheetTitle, spreadsheet)
+	// A retry with the same idempotency key gets the first request's response back, rather than adding the object again
+	if idempotencyKey != "" {
+		requestHash := hashIdempotentRequest(spreadsheetTitle, sheetTitle, requestBody.ObjectId, requestBody.NewObject)
+		result, inProgress, mismatch := idempotencyKeys.begin(idempotencyKey, requestHash)
+		switch {
+		case mismatch:
+			writeError(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", IDEMPOTENCY_KEY_HEADER+" was already used for a different request")
+			return
+		case inProgress:
+			writeError(w, r, http.StatusConflict, "idempotency_key_in_use", "A request with this "+IDEMPOTENCY_KEY_HEADER+" is still being handled")
+			return
+		case result != nil:
+			w.Header().Set(IDEMPOTENT_REPLAYED_HEADER, "true")
+			writeJSON(w, r, result.status, result.responseBody)
+			return
+		}
+		// Does nothing once the response has been stored, otherwise frees the key up for a retry
+		defer idempotencyKeys.abandon(idempotencyKey)
+	}
 
-	var newObjectData []*sheets.CellData = make([]*sheets.CellData, 0)
+	spreadsheetId, err := getSpreadsheetId(r.Context(), spreadsheetTitle)
+	if err != nil {
+		writeSpreadsheetLookupError(w, r, spreadsheetTitle, err)
+		return
+	}
+	// The header row has the column headers and the schema, none of the rows below it are needed to append
+	cached, _, err := sheetStructureCache.get(r.Context(), spreadsheetId, sheetTitle)
+	if err != nil {
+		writeSheetReadError(w, r, spreadsheetTitle, sheetTitle, err)
+		return
+	}
+	sheet := cached.sheet
+	sheetId := sheet.Properties.SheetId
 
-	// Make a uuid and store it in the first column
-	newObjectId := uuid.New().String()
-	newObjectIdData := &sheets.CellData{UserEnteredValue: &sheets.ExtendedValue{StringValue: &newObjectId}}
-	newObjectData = append(newObjectData, newObjectIdData)
+	// The object ID is the client's, or derived from the idempotency key so that it's the same on every retry, or new
+	newObjectId := requestBody.ObjectId
+	if newObjectId == "" && idempotencyKey != "" {
+		newObjectId = objectIdForIdempotencyKey(spreadsheetId, sheetId, idempotencyKey)
+	}
+	if newObjectId == "" {
+		newObjectId = uuid.New().String()
+	} else if _, found := cached.rowIndex(newObjectId); found {
+		// Already added by a request whose response was lost, possibly before a restart. The row is read to make sure
+		// it's really still there.
+		_, _, _, found, err := readObjectRow(r.Context(), spreadsheetId, sheetTitle, newObjectId)
+		if err != nil {
+			writeSheetReadError(w, r, spreadsheetTitle, sheetTitle, err)
+			return
+		}
+		if found {
+			responseBody := addObjectResponseBody(newObjectId, spreadsheetId, sheetId)
+			if idempotencyKey != "" {
+				idempotencyKeys.finish(idempotencyKey, http.StatusCreated, responseBody)
+			}
+			w.Header().Set(IDEMPOTENT_REPLAYED_HEADER, "true")
+			writeJSON(w, r, http.StatusCreated, responseBody)
+			return
+		}
+	}
 
-	// Make a timestamp and store it in the second column
-	currLocalTime := time.Now().Local()
-	timezone, _ := currLocalTime.Zone()
-	timestamp := fmt.Sprintf("%s %s", currLocalTime.Format(time.RFC3339), timezone)
-	newObjectTimestampData := &sheets.CellData{UserEnteredValue: &sheets.ExtendedValue{StringValue: &timestamp}}
-	newObjectData = append(newObjectData, newObjectTimestampData)
+	columnHeaders := getColumnHeaders(sheet)
+	schema, err := getSheetSchema(sheet)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "invalid_schema", err.Error())
+		return
+	}
 
-	for _, value := range newObject {
-		newValue := &sheets.CellData{UserEnteredValue: &sheets.ExtendedValue{StringValue: &value}}
-		newObjectData = append(newObjectData, newValue)
+	newObjectRow, objectErr := newObjectRowData(columnHeaders, schema, newObjectId, newObjectTimestamp(), requestBody.NewObject)
+	if objectErr != nil {
+		writeErrorDetails(w, r, objectErr.status, objectErr.details)
+		return
 	}
 
-	_, err = sheetsService.Spreadsheets.BatchUpdate(spreadsheetId,
-		&sheets.BatchUpdateSpreadsheetRequest{
-			IncludeSpreadsheetInResponse: false,
-			Requests: []*sheets.Request{
-				{
-					AppendCells: &sheets.AppendCellsRequest{
-						Fields: "*",
-						Rows: []*sheets.RowData{
-							{
-								Values: newObjectData,
-							},
-						},
-						SheetId: sheetId,
-					},
+	// The object's ID is known up front, so the append can be retried without risking a duplicate row
+	err = appendObjectsWithRetries(r.Context(), spreadsheetId, sheetTitle, []string{newObjectId},
+		[]*sheets.Request{
+			{
+				AppendCells: &sheets.AppendCellsRequest{
+					Fields:  "*",
+					Rows:    []*sheets.RowData{newObjectRow},
+					SheetId: sheetId,
 				},
 			},
 		},
-	).Do()
+	)
 
 	if err != nil {
-		fmt.Printf("Error while trying to add sheet headers: %v\n", err)
-		w.WriteHeader(http.StatusConflict)
-		w.Write([]byte(string("Error while trying to add sheet headers")))
+		writeGoogleError(w, r, err, "Error while trying to add object to sheet")
 		return
 	}
 
+	responseBody := addObjectResponseBody(newObjectId, spreadsheetId, sheetId)
+	if idempotencyKey != "" {
+		idempotencyKeys.finish(idempotencyKey, http.StatusCreated, responseBody)
+	}
+
+	writeJSON(w, r, http.StatusCreated, responseBody)
+}
+
+func addObjectResponseBody(objectId string, spreadsheetId string, sheetId int64) map[string]any {
 	var responseBody map[string]any = make(map[string]any)
 
+	responseBody["ObjectId"] = objectId
 	responseBody["SheetUrl"] = buildSpreadsheetUrl(spreadsheetId, sheetId)
 
-	responseBodyBytes, err := json.Marshal(responseBody)
+	return responseBody
+}
+
+type UpdateObjectRequest struct {
+	SpreadsheetTitle string
+	SheetTitle       string
+	ObjectId         string
+	UpdatedFields    map[string]any
+}
+
+func updateObject(w http.ResponseWriter, r *http.Request) {
+
+	requestBody := new(UpdateObjectRequest)
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	err := decoder.Decode(&requestBody)
 	if err != nil {
-		log.Fatalf("Error turning response body to JSON bytes. Error: %v", err)
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Unable to unmarshal request body JSON. Error: "+err.Error())
+		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	w.Write(responseBodyBytes)
 
-}
+	var spreadsheetTitle string = requestBody.SpreadsheetTitle
+	var sheetTitle string = requestBody.SheetTitle
+	var objectId string = requestBody.ObjectId
+
+	// The id and datetime columns are owned by the server, so they can't be overwritten
+	for _, protectedColumn := range []string{"id", "datetime"} {
+		if _, ok := requestBody.UpdatedFields[protectedColumn]; ok {
+			writeError(w, r, http.StatusBadRequest, "protected_column", "Column "+protectedColumn+" cannot be updated")
+			return
+		}
+	}
 
-func getSpreadsheetId(spreadsheetTitle string) string {
-	spreadsheetJsonFilePath := "data/spreadsheetIDs.json"
-	spreadsheetJsonFile, err := os.ReadFile(spreadsheetJsonFilePath)
+	spreadsheetId, err := getSpreadsheetId(r.Context(), spreadsheetTitle)
 	if err != nil {
-		log.Fatalf("Unable to read Data Spreadsheet ID file: %v", err)
+		writeSpreadsheetLookupError(w, r, spreadsheetTitle, err)
+		return
+	}
+	unlock := rowIndexLocks.lock(spreadsheetId)
+	defer unlock()
+	cached, rowIndexToUpdate, currentRow, found, err := readObjectRow(r.Context(), spreadsheetId, sheetTitle, objectId)
+	if err != nil {
+		writeSheetReadError(w, r, spreadsheetTitle, sheetTitle, err)
+		return
+	}
+	sheet := cached.sheet
+
+	if !found {
+		writeError(w, r, http.StatusNotFound, "object_not_found", "Object not found: "+objectId)
+		return
 	}
 
-	var spreadsheetIdObject map[string]string
-	err = json.Unmarshal(spreadsheetJsonFile, &spreadsheetIdObject)
+	columnHeaders := getColumnHeaders(sheet)
+	updatedObject := rowToObject(columnHeaders, currentRow)
+
+	schema, err := getSheetSchema(sheet)
 	if err != nil {
-		log.Fatalf("Unable to decode Data Spreadsheet ID JSON: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "invalid_schema", err.Error())
+		return
+	}
+
+	fieldErrors := schema.checkUpdatedFields(requestBody.UpdatedFields)
+	if len(fieldErrors) > 0 {
+		writeFieldErrors(w, r, fieldErrors)
+		return
+	}
+
+	// One UpdateCells request per supplied column so that every other cell in the row is left alone
+	var updateRequests []*sheets.Request
+	var unknownColumns []string
+	for columnName, value := range requestBody.UpdatedFields {
+		columnIndex := slices.Index(columnHeaders, columnName)
+		if columnIndex == -1 {
+			unknownColumns = append(unknownColumns, columnName)
+			continue
+		}
+
+		newValue, err := newCellDataForColumn(value, schema.getColumn(columnName))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_object", fmt.Sprintf("Field %s %v", columnName, err))
+			return
+		}
+
+		updateRequests = append(updateRequests, &sheets.Request{
+			UpdateCells: &sheets.UpdateCellsRequest{
+				// Include the number format so that a date overwritten with a plain value stops displaying as a date
+				Fields: "userEnteredValue,userEnteredFormat.numberFormat",
+				Rows: []*sheets.RowData{
+					{
+						Values: []*sheets.CellData{newValue},
+					},
+				},
+				Start: &sheets.GridCoordinate{
+					SheetId:     sheet.Properties.SheetId,
+					RowIndex:    rowIndexToUpdate,
+					ColumnIndex: int64(columnIndex),
+				},
+			},
+		})
+		updatedObject[columnName] = value
+	}
+
+	if len(unknownColumns) > 0 {
+		slices.Sort(unknownColumns)
+		writeError(w, r, http.StatusBadRequest, "unknown_columns", fmt.Sprintf("Unknown columns for sheet %s: %v", sheetTitle, unknownColumns))
+		return
+	}
+
+	if len(updateRequests) > 0 {
+		// Writing the same values to the same cells twice is harmless, so unlike appends this can be retried
+		err = batchUpdateObjects(withIdempotentRetries(r.Context()), spreadsheetId, updateRequests)
+		if err != nil {
+			writeMutationError(w, r, err, "Error while trying to update object in sheet")
+			return
+		}
 	}
 
-	spreadsheetId := spreadsheetIdObject[spreadsheetTitle]
-	return spreadsheetId
+	var responseBody map[string]any = make(map[string]any)
+
+	// Like createSheet, we trust the update was applied rather than reading the row back
+	responseBody["UpdatedObject"] = updatedObject
+	responseBody["SheetUrl"] = buildSpreadsheetUrl(spreadsheetId, sheet.Properties.SheetId)
+
+	writeJSON(w, r, http.StatusOK, responseBody)
 }
 
-func getSheetId(sheetTitle string, spreadsheet *sheets.Spreadsheet) int64 {
-	sheetIndex := slices.IndexFunc(spreadsheet.Sheets, func(s *sheets.Sheet) bool {
-		return s.Properties.Title == sheetTitle
-	})
-	var sheetId int64 = spreadsheet.Sheets[sheetIndex].Properties.SheetId
-	return sheetId
+/*
+Turns the NewObject from a request into the values for each column after id and datetime, in column order.
+A JSON array is taken as-is, in the order it was sent. A JSON object is matched up against the sheet's column headers,
+so it can be sent in any order; columns it leaves out are left blank and fields that aren't a column are rejected.
+Values keep their JSON types (numbers as json.Number) so newCellData can write them as typed cells.
+*/
+func newObjectToRowValues(rawObject json.RawMessage, columnHeaders []string) ([]any, error) {
+	trimmedObject := bytes.TrimSpace(rawObject)
+	// null would decode into a nil map and add a blank row, so it's treated the same as leaving NewObject out
+	if len(trimmedObject) == 0 || bytes.Equal(trimmedObject, []byte("null")) {
+		return nil, errors.New("NewObject is required")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(trimmedObject))
+	decoder.UseNumber()
+
+	if trimmedObject[0] == '[' {
+		var positionalValues []any
+		err := decoder.Decode(&positionalValues)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read NewObject array. Error: %v", err)
+		}
+		return positionalValues, nil
+	}
+
+	var namedValues map[string]any
+	err := decoder.Decode(&namedValues)
+	if err != nil {
+		return nil, fmt.Errorf("NewObject must be a JSON object or array. Error: %v", err)
+	}
+
+	// The first two columns are always id and datetime, which the server fills in
+	var dataColumnHeaders []string
+	if len(columnHeaders) > 2 {
+		dataColumnHeaders = columnHeaders[2:]
+	}
+
+	var unknownFields []string
+	for fieldName := range namedValues {
+		if !slices.Contains(dataColumnHeaders, fieldName) {
+			unknownFields = append(unknownFields, fieldName)
+		}
+	}
+	if len(unknownFields) > 0 {
+		slices.Sort(unknownFields)
+		return nil, fmt.Errorf("Unknown fields for this sheet: %v", unknownFields)
+	}
+
+	var rowValues []any = make([]any, len(dataColumnHeaders))
+	for columnIndex, columnHeader := range dataColumnHeaders {
+		rowValues[columnIndex] = namedValues[columnHeader]
+	}
+
+	return rowValues, nil
 }
 
-func buildSpreadsheetUrl(spreadsheetId string, sheetId int64) string {
-	return fmt.Sprintf("https://docs.google.com/spreadsheets/d/%s?gid=%d", spreadsheetId, sheetId)
+// A new object that can't be added, with the status and error it gets when it's the only object in the request
+type invalidObjectError struct {
+	status  int
+	details ErrorDetails
 }
 
-func findRowIndexByObjectId(objectId string, sheetTitle string, spreadsheet *sheets.Spreadsheet) int64 {
+/*
+Turns a NewObject from a request into the row to append: its ID, then the timestamp, then its values in column order
+with the schema's defaults and types applied.
+*/
+func newObjectRowData(columnHeaders []string, schema SheetSchema, objectId string, timestamp string, rawObject json.RawMessage) (*sheets.RowData, *invalidObjectError) {
+	newObject, err := newObjectToRowValues(rawObject, columnHeaders)
+	if err != nil {
+		return nil, &invalidObjectError{http.StatusBadRequest, ErrorDetails{Code: "invalid_object", Message: err.Error()}}
+	}
+
+	if schema != nil {
+		var fieldErrors []FieldError
+		newObject, fieldErrors = schema.applyToNewObject(columnHeaders, newObject)
+		if len(fieldErrors) > 0 {
+			return nil, &invalidObjectError{http.StatusUnprocessableEntity, ErrorDetails{
+				Code:        "schema_violation",
+				Message:     "The object doesn't match the sheet's schema",
+				FieldErrors: fieldErrors,
+			}}
+		}
+	}
 
-	var rowIndex int64
+	// The object's ID goes in the first column and the timestamp in the second
+	var newObjectData []*sheets.CellData = []*sheets.CellData{newStringCellData(objectId), newStringCellData(timestamp)}
 
-	for _, sheet := range spreadsheet.Sheets {
-		if sheet.Properties.Title == sheetTitle {
-			if len(sheet.Data) == 0 {
-				return rowIndex
-			}
-			
-			for index, row := range sheet.Data[0].RowData {
-				
-				if (row.Values[0].FormattedValue == objectId) {
-					rowIndex = int64(index)
-					break
-				}
-			}
-			break
+	for valueIndex, value := range newObject {
+		var column *ColumnSchema
+		fieldName := fmt.Sprintf("at position %d", valueIndex)
+		if valueIndex+2 < len(columnHeaders) {
+			fieldName = columnHeaders[valueIndex+2]
+			column = schema.getColumn(fieldName)
 		}
 
+		newValue, err := newCellDataForColumn(value, column)
+		if err != nil {
+			return nil, &invalidObjectError{http.StatusBadRequest, ErrorDetails{Code: "invalid_object", Message: fmt.Sprintf("Field %s %v", fieldName, err)}}
+		}
+		newObjectData = append(newObjectData, newValue)
+	}
+
+	return &sheets.RowData{Values: newObjectData}, nil
+}
+
+// The datetime column's value for objects added now
+func newObjectTimestamp() string {
+	currLocalTime := time.Now().Local()
+	timezone, _ := currLocalTime.Zone()
+	return fmt.Sprintf("%s %s", currLocalTime.Format(time.RFC3339), timezone)
+}
+
+// Column headers always live in the first row of the sheet
+func getColumnHeaders(sheet *sheets.Sheet) []string {
+	var columnHeaders []string
+	if len(sheet.Data) == 0 || len(sheet.Data[0].RowData) == 0 {
+		return columnHeaders
+	}
+	for _, rowValue := range sheet.Data[0].RowData[0].Values {
+		columnHeaders = append(columnHeaders, rowValue.FormattedValue)
+	}
+	return columnHeaders
+}
+
+// Maps a row's cells to their column headers. Sheets leaves trailing empty cells off of a row, so those come back as ""
+func rowToObject(columnHeaders []string, row *sheets.RowData) map[string]any {
+	var object map[string]any = make(map[string]any)
+	for columnIndex, columnHeader := range columnHeaders {
+		if columnIndex < len(row.Values) {
+			object[columnHeader] = cellToValue(row.Values[columnIndex])
+		} else {
+			object[columnHeader] = ""
+		}
 	}
+	return object
+}
 
-	return rowIndex
+func buildSpreadsheetUrl(spreadsheetId string, sheetId int64) string {
+	return fmt.Sprintf("https://docs.google.com/spreadsheets/d/%s?gid=%d", spreadsheetId, sheetId)
 }
 
 /*
-return values: columnHeaders string[], sheetData map[int][]string, error
+Reads up to numRows rows that come after the cursor (or from the top of the sheet if the cursor is nil), in sheet row order.
+The cached id column is used to find where the page starts, so only the rows on the page are read. If they don't have the
+ids the cache expected, the sheet has changed since it was cached and the page is read again. If they still don't match
+after a fresh read, the sheet is changing under us and ErrSheetChangedDuringRead is returned rather than an empty page.
+With a filter query, only objects that match it are returned, and rows are read in chunks until the page is full. At
+most MAX_FILTER_SCAN_ROWS rows are read per page, so a page can have fewer rows than asked for (even none) and still have a
+next cursor, which carries on from the last row that was read.
+return values: columnHeaders string[], pageRows []sheetPageRow, nextCursor string, error
+nextCursor is empty when there are no more rows to read.
 */
-func readNRowsFromSheetByTitle(numRows int, sheetTitle string, spreadsheet *sheets.Spreadsheet) ([]string, map[string]map[string]string, error) {
-	var columnHeaders []string
-	var sheetData map[string]map[string]string = make(map[string]map[string]string)
-	for _, sheet := range spreadsheet.Sheets {
-		if sheet.Properties.Title != sheetTitle {
-			continue
+func readPageFromSheetByTitle(ctx context.Context, numRows int, cursor *sheetCursor, filterQuery string, spreadsheetId string, sheetTitle string) ([]string, []sheetPageRow, string, error) {
+	for attempt := 1; ; attempt++ {
+		cached, justRead, err := sheetStructureCache.get(ctx, spreadsheetId, sheetTitle)
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		columnHeaders, pageRows, nextCursor, matchedCache, err := readPageFromCachedSheet(ctx, numRows, cursor, filterQuery, spreadsheetId, sheetTitle, cached)
+		if err != nil || matchedCache {
+			return columnHeaders, pageRows, nextCursor, err
+		}
+		if justRead || attempt == 2 {
+			return nil, nil, "", ErrSheetChangedDuringRead
 		}
+		sheetStructureCache.invalidate(spreadsheetId, sheetTitle)
+	}
+}
+
+func readPageFromCachedSheet(ctx context.Context, numRows int, cursor *sheetCursor, filterQuery string, spreadsheetId string, sheetTitle string, cached *cachedSheet) ([]string, []sheetPageRow, string, bool, error) {
+	var pageRows []sheetPageRow
+	var nextCursor string
 
-		if len(sheet.Data) == 0 {
-			return columnHeaders, sheetData, nil
+	columnHeaders := getColumnHeaders(cached.sheet)
+	ids := cached.ids
+
+	var filter filterExpression
+	if filterQuery != "" {
+		var err error
+		filter, err = parseFilter(filterQuery, columnHeaders)
+		if err != nil {
+			return nil, nil, "", false, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
 		}
+	}
 
-		for index, row := range sheet.Data[0].RowData {
-			if index > numRows {
-				break
+	// The row the cursor points at, or just before where it was if it's been deleted. Row 0 is the column header row.
+	cursorRowIndex := 0
+	if cursor != nil && cursor.ObjectId != "" {
+		cachedRowIndex, cursorFound := cached.rowIndex(cursor.ObjectId)
+		cursorRowIndex = int(cachedRowIndex)
+		if !cursorFound {
+			// The cursor's row has been deleted, so it's found by its datetime instead, which isn't cached
+			cursorSheet, err := getSheetRanges(ctx, spreadsheetId, sheetTitle, LOOKUP_FIELDS, "A:B")
+			if err != nil {
+				return nil, nil, "", false, err
 			}
+			cursorRows := cursorSheet.Data[0].RowData
+			cursorRowIndex = findCursorRowIndex(cursorRows, cursor)
 
-			if index == 0 {
-				for _, rowValue := range row.Values {
-					columnHeaders = append(columnHeaders, rowValue.FormattedValue)
-				}
-				continue
+			ids = nil
+			for _, row := range cursorRows {
+				ids = append(ids, cellFormattedValue(row, 0))
+			}
+		}
+	}
+	startIndex := cursorRowIndex + 1
+	if cursor != nil {
+		startIndex += cursor.BlankRows
+	}
+
+	// Without a filter every row is on the page, so exactly the page is read
+	scanLimit, chunkSize := numRows, numRows
+	if filter != nil {
+		scanLimit, chunkSize = MAX_FILTER_SCAN_ROWS, FILTER_SCAN_CHUNK_ROWS
+	}
+	scanEndIndex := min(startIndex+scanLimit, len(ids))
+	if startIndex >= scanEndIndex {
+		return columnHeaders, pageRows, nextCursor, true, nil
+	}
+
+	lastScannedIndex := startIndex - 1
+	// The next cursor points at the last object that was read, which is this page's cursor's row until another one is
+	var nextPageCursor sheetCursor
+	if cursor != nil {
+		nextPageCursor = sheetCursor{ObjectId: cursor.ObjectId, Datetime: cursor.Datetime}
+	}
+	lastObjectIndex := cursorRowIndex
+	for chunkStart := startIndex; chunkStart < scanEndIndex && len(pageRows) < numRows; {
+		chunkEnd := min(chunkStart+chunkSize, scanEndIndex)
+		pageSheet, err := getSheetRanges(ctx, spreadsheetId, sheetTitle, ROW_FIELDS, rowsRange(chunkStart, chunkEnd))
+		if err != nil {
+			return nil, nil, "", false, err
+		}
+		rows := pageSheet.Data[0].RowData
+
+		for index := chunkStart; index < chunkEnd && len(pageRows) < numRows; index++ {
+			// Sheets leaves blank rows at the end of the range off, so those are read as an empty row
+			row := &sheets.RowData{}
+			if index-chunkStart < len(rows) {
+				row = rows[index-chunkStart]
+			}
+			if cellFormattedValue(row, 0) != ids[index] {
+				return nil, nil, "", false, nil
+			}
+			lastScannedIndex = index
+			if ids[index] != "" {
+				nextPageCursor = cursorForRow(row)
+				lastObjectIndex = index
 			}
 
-			var newRow map[string]string = make(map[string]string)
-			for columnIndex, rowValue := range row.Values {
-				newRow[columnHeaders[columnIndex]] = rowValue.FormattedValue
+			object := rowToObject(columnHeaders, row)
+			if filter != nil && (ids[index] == "" || !filter.matches(object)) {
+				continue
 			}
-			sheetData[fmt.Sprintf("Row%v", index)] = newRow
+			pageRows = append(pageRows, sheetPageRow{rowIndex: index, object: object, row: row})
 		}
-		break
+		chunkStart = chunkEnd
 	}
 
-	if columnHeaders == nil {
-		return nil, nil, errors.New("Unable to find requested sheet " + sheetTitle + " in " + spreadsheet.Properties.Title)
+	if lastScannedIndex+1 < len(ids) {
+		nextPageCursor.BlankRows = lastScannedIndex - lastObjectIndex
+		nextCursor = encodeCursor(nextPageCursor)
 	}
 
-	return columnHeaders, sheetData, nil
+	return columnHeaders, pageRows, nextCursor, true, nil
 }
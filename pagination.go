@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+const MAX_PAGE_SIZE = 1000
+
+// Column index of the datetime column that createSheet prepends to every sheet
+const DATETIME_COLUMN_INDEX = 1
+
+/*
+A cursor points at the last row a client has already seen. It's keyed by object ID rather than row number, because
+deleteObject shifts every row below the deleted one up and a row number would then skip rows. If the row the cursor
+points at gets deleted itself, we fall back to its creation datetime, since rows are only ever appended and so are in
+datetime order.
+A page can end on blank rows, which have no ID, so the cursor also counts the blank rows that were read after its row.
+If no object has been read yet, ObjectId is empty and the blank rows are counted from the column header row.
+*/
+type sheetCursor struct {
+	ObjectId  string `json:"id"`
+	Datetime  string `json:"dt"`
+	BlankRows int    `json:"b,omitempty"`
+	// Only for sorted pages, the sort parameter and the row's values for it (see readSortedPageFromSheet)
+	Sort       string `json:"s,omitempty"`
+	SortValues []any  `json:"sv,omitempty"`
+}
+
+// One row of a page from readSheetData, with its index in the sheet
+type sheetPageRow struct {
+	rowIndex int
+	object   map[string]any
+	row      *sheets.RowData
+}
+
+func encodeCursor(cursor sheetCursor) string {
+	cursorBytes, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
+
+func decodeCursor(encodedCursor string) (*sheetCursor, error) {
+	if encodedCursor == "" {
+		return nil, nil
+	}
+
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(encodedCursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	cursor := new(sheetCursor)
+	err = json.Unmarshal(cursorBytes, cursor)
+	if err != nil || cursor.BlankRows < 0 || (cursor.ObjectId == "" && cursor.BlankRows == 0) {
+		return nil, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+func cursorForRow(row *sheets.RowData) sheetCursor {
+	return sheetCursor{
+		ObjectId: cellFormattedValue(row, 0),
+		Datetime: cellFormattedValue(row, DATETIME_COLUMN_INDEX),
+	}
+}
+
+// Parses the limit query parameter, falling back to the configured default page size when it isn't set
+func parsePageLimit(limitParam string) (int, error) {
+	if limitParam == "" {
+		return serverConfig.DefaultPageSize, nil
+	}
+
+	limit, err := strconv.Atoi(limitParam)
+	if err != nil || limit < 1 || limit > MAX_PAGE_SIZE {
+		return 0, errors.New("limit must be a number between 1 and " + strconv.Itoa(MAX_PAGE_SIZE))
+	}
+	return limit, nil
+}
+
+/*
+Returns the index of the cursor's row, or if it's been deleted, of the row just before where it was. Index 0 is the
+column header row, which is where a cursor without an object ID counts from. The page after the cursor starts
+cursor.BlankRows rows below this.
+*/
+func findCursorRowIndex(rows []*sheets.RowData, cursor *sheetCursor) int {
+	if cursor.ObjectId == "" {
+		return 0
+	}
+
+	for index := 1; index < len(rows); index++ {
+		if cellFormattedValue(rows[index], 0) == cursor.ObjectId {
+			return index
+		}
+	}
+
+	// The cursor's row was deleted, so pick up at the first row created at or after it. Rows created in the same
+	// second may be returned twice, which is better than skipping them. Blank rows have no datetime, so blank rows that
+	// were right after the cursor's row are skipped.
+	cursorTime, ok := parseRowDatetime(cursor.Datetime)
+	if !ok {
+		return max(len(rows)-1, 0)
+	}
+	for index := 1; index < len(rows); index++ {
+		rowTime, ok := parseRowDatetime(cellFormattedValue(rows[index], DATETIME_COLUMN_INDEX))
+		if ok && !rowTime.Before(cursorTime) {
+			return index - 1
+		}
+	}
+	return max(len(rows)-1, 0)
+}
+
+// The datetime column is written by addObjectToSheet as "<RFC3339> <timezone name>"
+func parseRowDatetime(datetime string) (time.Time, bool) {
+	datetimeFields := strings.Fields(datetime)
+	if len(datetimeFields) == 0 {
+		return time.Time{}, false
+	}
+	parsedTime, err := time.Parse(time.RFC3339, datetimeFields[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return parsedTime, true
+}
+
+func cellFormattedValue(row *sheets.RowData, columnIndex int) string {
+	if row == nil || columnIndex >= len(row.Values) {
+		return ""
+	}
+	return row.Values[columnIndex].FormattedValue
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+func TestDecodeCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		cursor  sheetCursor
+		wantErr bool
+	}{
+		{"object", sheetCursor{ObjectId: "a", Datetime: "2024-01-01T00:00:00Z UTC"}, false},
+		{"object then blank rows", sheetCursor{ObjectId: "a", BlankRows: 2}, false},
+		{"blank rows below the header", sheetCursor{BlankRows: 3}, false},
+		{"nothing", sheetCursor{}, true},
+		{"negative blank rows", sheetCursor{ObjectId: "a", BlankRows: -1}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cursor, err := decodeCursor(encodeCursor(test.cursor))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("decodeCursor accepted %+v", test.cursor)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeCursor(%+v) error = %v", test.cursor, err)
+			}
+			if !reflect.DeepEqual(*cursor, test.cursor) {
+				t.Errorf("decodeCursor = %+v, want %+v", *cursor, test.cursor)
+			}
+		})
+	}
+}
+
+// Builds the cache entry for the fake sheet the way sheetStructureCache would
+func fakeCachedSheet(fake *fakeSheets) *cachedSheet {
+	var headerRow []*sheets.CellData
+	for _, header := range fake.rows[0] {
+		headerRow = append(headerRow, &sheets.CellData{FormattedValue: header})
+	}
+	ids := fake.ids()
+	// Sheets leaves the blank rows at the end of the id column off
+	for len(ids) > 0 && ids[len(ids)-1] == "" {
+		ids = ids[:len(ids)-1]
+	}
+	var idRows []*sheets.RowData
+	for _, objectId := range ids {
+		idRows = append(idRows, &sheets.RowData{Values: []*sheets.CellData{{FormattedValue: objectId}}})
+	}
+	return newCachedSheet(&sheets.Sheet{
+		Properties: &sheets.SheetProperties{SheetId: FAKE_SHEET_ID, Title: FAKE_SHEET_TITLE},
+		Data:       []*sheets.GridData{{RowData: []*sheets.RowData{{Values: headerRow}}}, {RowData: idRows}},
+	}, 0)
+}
+
+func TestReadPageFromCachedSheetBlankRows(t *testing.T) {
+	rows := [][]string{
+		{"id", "datetime", "name"},
+		{"a", "2024-01-01T00:00:01Z UTC", "Ada"},
+		{},
+		{},
+		{"b", "2024-01-01T00:00:02Z UTC", "Bea"},
+		{},
+		{"c", "2024-01-01T00:00:03Z UTC", "Cy"},
+		{},
+		{"d", "2024-01-01T00:00:04Z UTC", "Di"},
+	}
+	blankFirstRows := [][]string{
+		{"id", "datetime", "name"},
+		{},
+		{},
+		{"a", "2024-01-01T00:00:01Z UTC", "Ada"},
+		{},
+	}
+
+	tests := []struct {
+		name        string
+		rows        [][]string
+		limit       int
+		filterQuery string
+		// Row indexes in the order all the pages return them
+		want []int
+	}{
+		{"pages end on blank rows", rows, 2, "", []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"pages of one row", rows, 1, "", []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"pages of three rows", rows, 3, "", []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"blank rows below the header", blankFirstRows, 1, "", []int{1, 2, 3}},
+		{"blank rows below the header, bigger page", blankFirstRows, 2, "", []int{1, 2, 3}},
+		{"filtered", rows, 1, `name != "Bea"`, []int{1, 6, 8}},
+		{"filtered with blank rows below the header", blankFirstRows, 1, "name = Ada", []int{3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeSheets(t, test.rows)
+			cached := fakeCachedSheet(fake)
+
+			var got []int
+			var cursor *sheetCursor
+			for page := 0; ; page++ {
+				if page > len(test.rows) {
+					t.Fatalf("still paging after %d pages, got %v", page, got)
+				}
+				_, pageRows, nextCursor, matchedCache, err := readPageFromCachedSheet(context.Background(), test.limit, cursor, test.filterQuery, "spreadsheet", FAKE_SHEET_TITLE, cached)
+				if err != nil || !matchedCache {
+					t.Fatalf("page %d: matchedCache = %v, error = %v", page, matchedCache, err)
+				}
+				for _, pageRow := range pageRows {
+					got = append(got, pageRow.rowIndex)
+				}
+				if nextCursor == "" {
+					break
+				}
+				// The cursor has to make it through readSheetData's cursor parameter
+				cursor, err = decodeCursor(nextCursor)
+				if err != nil {
+					t.Fatalf("page %d: NextCursor %q can't be decoded: %v", page, nextCursor, err)
+				}
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("pages returned rows %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindCursorRowIndex(t *testing.T) {
+	newRow := func(objectId string, datetime string) *sheets.RowData {
+		return &sheets.RowData{Values: []*sheets.CellData{{FormattedValue: objectId}, {FormattedValue: datetime}}}
+	}
+	rows := []*sheets.RowData{
+		newRow("id", "datetime"),
+		newRow("a", "2024-01-01T00:00:01Z UTC"),
+		{},
+		newRow("c", "2024-01-01T00:00:03Z UTC"),
+	}
+
+	tests := []struct {
+		name   string
+		cursor sheetCursor
+		want   int
+	}{
+		{"found", sheetCursor{ObjectId: "c"}, 3},
+		{"no object yet", sheetCursor{BlankRows: 2}, 0},
+		{"deleted, picks up before the next row created after it", sheetCursor{ObjectId: "b", Datetime: "2024-01-01T00:00:02Z UTC"}, 2},
+		{"deleted, nothing created after it", sheetCursor{ObjectId: "z", Datetime: "2024-01-01T00:00:09Z UTC"}, 3},
+		{"deleted, without a datetime", sheetCursor{ObjectId: "z"}, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := findCursorRowIndex(rows, &test.cursor); got != test.want {
+				t.Errorf("findCursorRowIndex = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrSpreadsheetNotRegistered = errors.New("spreadsheet is not in the registry")
+var ErrSpreadsheetAlreadyRegistered = errors.New("a spreadsheet with that title is already in the registry")
+
+/*
+The registry keeps the association between spreadsheet titles and spreadsheet IDs. Google only knows spreadsheets by
+their IDs, but clients of this server only know them by their titles.
+*/
+type Registry interface {
+	// Returns the ID registered for the title, and false if there isn't one
+	Lookup(title string) (string, bool, error)
+	// Adds the title, or points it at a new ID if it's already registered
+	Register(title string, spreadsheetId string) error
+	Rename(oldTitle string, newTitle string) error
+	Remove(title string) error
+	// Returns every title -> ID pair in the registry
+	List() (map[string]string, error)
+	// Releases the registry's file, called when the server shuts down
+	Close() error
+}
+
+func newRegistry(backend string, path string, permissions os.FileMode) (Registry, error) {
+	switch backend {
+	case "json":
+		return newJsonFileRegistry(path, permissions), nil
+	case "bolt":
+		return newBoltRegistry(path, permissions)
+	default:
+		return nil, errors.New("unknown registry backend " + backend + ", must be json or bolt")
+	}
+}
+
+/*
+Stores the registry as a single JSON object in a file, which is the original data/spreadsheetIDs.json format. Every
+change rewrites the whole file, so writes are done atomically and behind a mutex so that concurrent requests can't lose
+each other's entries.
+*/
+type jsonFileRegistry struct {
+	path        string
+	permissions os.FileMode
+	mu          sync.Mutex
+}
+
+func newJsonFileRegistry(path string, permissions os.FileMode) *jsonFileRegistry {
+	return &jsonFileRegistry{path: path, permissions: permissions}
+}
+
+func (registry *jsonFileRegistry) Lookup(title string) (string, bool, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	spreadsheetIds, err := registry.read()
+	if err != nil {
+		return "", false, err
+	}
+	spreadsheetId, ok := spreadsheetIds[title]
+	return spreadsheetId, ok, nil
+}
+
+func (registry *jsonFileRegistry) Register(title string, spreadsheetId string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	spreadsheetIds, err := registry.read()
+	if err != nil {
+		return err
+	}
+	spreadsheetIds[title] = spreadsheetId
+	return registry.write(spreadsheetIds)
+}
+
+func (registry *jsonFileRegistry) Rename(oldTitle string, newTitle string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	spreadsheetIds, err := registry.read()
+	if err != nil {
+		return err
+	}
+	spreadsheetId, ok := spreadsheetIds[oldTitle]
+	if !ok {
+		return ErrSpreadsheetNotRegistered
+	}
+	if _, ok := spreadsheetIds[newTitle]; ok {
+		return ErrSpreadsheetAlreadyRegistered
+	}
+	delete(spreadsheetIds, oldTitle)
+	spreadsheetIds[newTitle] = spreadsheetId
+	return registry.write(spreadsheetIds)
+}
+
+func (registry *jsonFileRegistry) Remove(title string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	spreadsheetIds, err := registry.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := spreadsheetIds[title]; !ok {
+		return ErrSpreadsheetNotRegistered
+	}
+	delete(spreadsheetIds, title)
+	return registry.write(spreadsheetIds)
+}
+
+func (registry *jsonFileRegistry) List() (map[string]string, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	return registry.read()
+}
+
+// The file is read on every call rather than kept in memory, so it can still be edited by hand while the server runs
+func (registry *jsonFileRegistry) read() (map[string]string, error) {
+	var spreadsheetIds map[string]string = make(map[string]string)
+
+	spreadsheetJsonFile, err := os.ReadFile(registry.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return spreadsheetIds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(spreadsheetJsonFile, &spreadsheetIds)
+	if err != nil {
+		return nil, err
+	}
+	return spreadsheetIds, nil
+}
+
+func (registry *jsonFileRegistry) write(spreadsheetIds map[string]string) error {
+	dataBytes, err := json.Marshal(spreadsheetIds)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(registry.path, dataBytes, registry.permissions)
+}
+
+// Every call reads and writes the file itself, so there's nothing held open
+func (registry *jsonFileRegistry) Close() error {
+	return nil
+}
+
+var boltRegistryBucket = []byte("spreadsheets")
+
+// Stores the registry in an embedded bolt key-value database, which handles its own locking and atomic writes
+// How long to wait for another process to let go of the bolt registry's file before giving up on starting
+const BOLT_OPEN_TIMEOUT = time.Second
+
+type boltRegistry struct {
+	db *bolt.DB
+}
+
+func newBoltRegistry(path string, permissions os.FileMode) (*boltRegistry, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bolt locks the file while it's open, so without a timeout a second server using it would hang here forever
+	db, err := bolt.Open(path, permissions, &bolt.Options{Timeout: BOLT_OPEN_TIMEOUT})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("registry database %s is locked, is another server using it?", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRegistryBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltRegistry{db: db}, nil
+}
+
+func (registry *boltRegistry) Lookup(title string) (string, bool, error) {
+	var spreadsheetId []byte
+	err := registry.db.View(func(tx *bolt.Tx) error {
+		// Values from bolt are only valid during the transaction, so copy it out
+		spreadsheetId = append(spreadsheetId, tx.Bucket(boltRegistryBucket).Get([]byte(title))...)
+		return nil
+	})
+	if err != nil || spreadsheetId == nil {
+		return "", false, err
+	}
+	return string(spreadsheetId), true, nil
+}
+
+func (registry *boltRegistry) Register(title string, spreadsheetId string) error {
+	return registry.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRegistryBucket).Put([]byte(title), []byte(spreadsheetId))
+	})
+}
+
+func (registry *boltRegistry) Rename(oldTitle string, newTitle string) error {
+	return registry.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRegistryBucket)
+		spreadsheetId := bucket.Get([]byte(oldTitle))
+		if spreadsheetId == nil {
+			return ErrSpreadsheetNotRegistered
+		}
+		if bucket.Get([]byte(newTitle)) != nil {
+			return ErrSpreadsheetAlreadyRegistered
+		}
+		err := bucket.Put([]byte(newTitle), append([]byte(nil), spreadsheetId...))
+		if err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(oldTitle))
+	})
+}
+
+func (registry *boltRegistry) Remove(title string) error {
+	return registry.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRegistryBucket)
+		if bucket.Get([]byte(title)) == nil {
+			return ErrSpreadsheetNotRegistered
+		}
+		return bucket.Delete([]byte(title))
+	})
+}
+
+func (registry *boltRegistry) List() (map[string]string, error) {
+	var spreadsheetIds map[string]string = make(map[string]string)
+	err := registry.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRegistryBucket).ForEach(func(title []byte, spreadsheetId []byte) error {
+			spreadsheetIds[string(title)] = string(spreadsheetId)
+			return nil
+		})
+	})
+	return spreadsheetIds, err
+}
+
+func (registry *boltRegistry) Close() error {
+	return registry.db.Close()
+}
+
+/*
+Writes to a temp file in the same directory and renames it over the original, so a crash or a concurrent reader never
+sees a half-written file.
+*/
+func writeFileAtomic(path string, data []byte, permissions os.FileMode) error {
+	directory := filepath.Dir(path)
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(directory, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// Does nothing once the rename has happened
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tempFile.Name(), permissions)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
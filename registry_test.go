@@ -0,0 +1,21 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewBoltRegistryLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spreadsheetIDs.db")
+	registry, err := newBoltRegistry(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+
+	_, err = newBoltRegistry(path, 0600)
+	if err == nil || !strings.Contains(err.Error(), "registry database "+path+" is locked") {
+		t.Errorf("opening it again error = %v, want it to say the registry database is locked", err)
+	}
+}
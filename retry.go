@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// The wait before the first retry, doubled for every retry after that up to RETRY_MAX_INTERVAL
+const RETRY_INITIAL_INTERVAL = 500 * time.Millisecond
+const RETRY_MAX_INTERVAL = 16 * time.Second
+
+/*
+Exponential backoff with jitter. Each wait is picked at random from the upper half of the current interval, so clients
+that hit the quota at the same moment don't all come back at the same moment too.
+*/
+type backoff struct {
+	interval time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	if b.interval == 0 {
+		b.interval = RETRY_INITIAL_INTERVAL
+	}
+	wait := b.interval/2 + rand.N(b.interval/2+1)
+	b.interval = min(b.interval*2, RETRY_MAX_INTERVAL)
+	return wait
+}
+
+// Waits for the duration, returning early with the context's error if it's cancelled first
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+When a call has to stop retrying: maxElapsed after its first attempt, or the context's deadline if that comes first.
+A request's context has a deadline (see withRequestId), so the calls a handler makes one after another share the time
+the request has left rather than each getting maxElapsed of its own.
+*/
+func retryDeadline(ctx context.Context, maxElapsed time.Duration) time.Time {
+	deadline := time.Now().Add(maxElapsed)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+type idempotentContextKey struct{}
+
+/*
+Marks Google calls made with the context as safe to send twice. POSTs are never retried otherwise, because most Sheets
+POSTs (appending rows, adding sheets, creating spreadsheets) would be applied twice if the first attempt went through
+and only the response was lost.
+*/
+func withIdempotentRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentContextKey{}, true)
+}
+
+/*
+Retries Sheets and Drive calls that failed with a quota error (429) or a Google server error (5xx), or whose attempt
+timed out or had its connection reset. Retries back off exponentially and honour Retry-After, and stop at the
+deadline from retryDeadline. Each attempt gets its own timeout, so one slow attempt doesn't use up the time for the
+retries.
+*/
+type retryTransport struct {
+	next           http.RoundTripper
+	attemptTimeout time.Duration
+	maxElapsed     time.Duration
+}
+
+func newRetryTransport(next http.RoundTripper, attemptTimeout time.Duration, maxElapsed time.Duration) *retryTransport {
+	return &retryTransport{next: next, attemptTimeout: attemptTimeout, maxElapsed: maxElapsed}
+}
+
+func (transport *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	retryable := isIdempotentRequest(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+	deadline := retryDeadline(ctx, transport.maxElapsed)
+	var retryBackoff backoff
+
+	for attempt := 1; ; attempt++ {
+		attemptReq, cancel, err := transport.newAttempt(req, attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := transport.next.RoundTrip(attemptReq)
+		if !retryable || !shouldRetry(ctx, resp, err) {
+			return withCancelOnClose(resp, cancel), err
+		}
+
+		wait := retryBackoff.next()
+		if resp != nil {
+			wait = max(wait, retryAfter(resp))
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return withCancelOnClose(resp, cancel), err
+		}
+
+		if resp != nil {
+			log.Printf("Retrying %s %s in %v after a %d (attempt %d)", req.Method, req.URL.Path, wait, resp.StatusCode, attempt)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			log.Printf("Retrying %s %s in %v after %v (attempt %d)", req.Method, req.URL.Path, wait, err, attempt)
+		}
+		cancel()
+
+		err = sleepContext(ctx, wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Copies the request for one attempt, with a fresh body and the per-attempt timeout
+func (transport *retryTransport) newAttempt(req *http.Request, attempt int) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), transport.attemptTimeout)
+	attemptReq := req.Clone(ctx)
+
+	if attempt > 1 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		attemptReq.Body = body
+	}
+	return attemptReq, cancel, nil
+}
+
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	idempotent, _ := req.Context().Value(idempotentContextKey{}).(bool)
+	return idempotent
+}
+
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// A rejected token (e.g. invalid_grant), a bad certificate or an unknown host will fail the same way every time,
+		// so only an attempt timing out or its connection being reset is worth another try
+		var tokenErr *oauth2.RetrieveError
+		if errors.As(err, &tokenErr) {
+			return false
+		}
+		return isTimeout(err) || errors.Is(err, syscall.ECONNRESET)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// Whether a Sheets or Drive call that returned an error is worth trying again, for calls made outside the retry transport
+func isRetryableGoogleError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code == http.StatusTooManyRequests || googleErr.Code >= http.StatusInternalServerError
+	}
+	return isTimeout(err)
+}
+
+func googleRetryAfter(err error) time.Duration {
+	var googleErr *googleapi.Error
+	if !errors.As(err, &googleErr) {
+		return 0
+	}
+	return retryAfter(&http.Response{Header: googleErr.Header})
+}
+
+// Reads Retry-After, which Google sends as a number of seconds but HTTP also allows as a date
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// The attempt's timeout has to stay running until the caller has read the body, so it's cancelled when the body is closed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnCloseBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+func withCancelOnClose(resp *http.Response, cancel context.CancelFunc) *http.Response {
+	if resp == nil {
+		cancel()
+		return nil
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryDeadline(t *testing.T) {
+	soon, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	later, cancelLater := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelLater()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		maxElapsed time.Duration
+		want       time.Duration
+	}{
+		{"no request deadline", context.Background(), time.Minute, time.Minute},
+		{"request deadline first", soon, time.Minute, time.Second},
+		{"maxElapsed first", later, time.Minute, time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := time.Until(retryDeadline(test.ctx, test.maxElapsed))
+			if got > test.want || got < test.want-time.Second/2 {
+				t.Errorf("retryDeadline is %v away, want about %v", got, test.want)
+			}
+		})
+	}
+}
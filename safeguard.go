@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+var ErrUnsafeMutation = errors.New("refusing to change the column header row or the id and datetime columns")
+
+// The first column after id and datetime, the first one that a client's values go in
+const FIRST_VALUE_COLUMN_INDEX = DATETIME_COLUMN_INDEX + 1
+
+/*
+The last check on every request that changes or deletes objects. Finding the wrong row is a bug somewhere else (a lookup
+that returned 0 for "not found" used to delete the column header row), but this way such a bug can't damage the sheet's
+structure: the column header row can never be changed or deleted, nor can the id and datetime columns, which the server
+owns. Only whole object rows can be deleted, so the rest of a row can't be left without its id.
+*/
+func checkObjectMutation(request *sheets.Request) error {
+	switch {
+	case request.AppendCells != nil:
+		// Appended rows always go below the last row, and new rows are where ids and datetimes get written
+		return nil
+
+	case request.UpdateCells != nil:
+		updateCells := request.UpdateCells
+		if updateCells.Start != nil {
+			if updateCells.Start.RowIndex < 1 || updateCells.Start.ColumnIndex < FIRST_VALUE_COLUMN_INDEX {
+				return fmt.Errorf("%w: cells starting at row %d, column %d", ErrUnsafeMutation, updateCells.Start.RowIndex, updateCells.Start.ColumnIndex)
+			}
+			return nil
+		}
+		// An unset start index is the first row or column, so a range that leaves them out covers the protected ones too
+		if updateCells.Range == nil || updateCells.Range.StartRowIndex < 1 || updateCells.Range.StartColumnIndex < FIRST_VALUE_COLUMN_INDEX {
+			return fmt.Errorf("%w: a cell range that includes the column header row or the id and datetime columns", ErrUnsafeMutation)
+		}
+		return nil
+
+	case request.DeleteRange != nil:
+		deleteRange := request.DeleteRange.Range
+		if deleteRange == nil || request.DeleteRange.ShiftDimension != "ROWS" || deleteRange.StartColumnIndex != 0 || deleteRange.EndColumnIndex != 0 {
+			return fmt.Errorf("%w: only whole rows can be deleted", ErrUnsafeMutation)
+		}
+		if deleteRange.StartRowIndex < 1 || deleteRange.EndRowIndex <= deleteRange.StartRowIndex {
+			return fmt.Errorf("%w: deleting rows %d to %d", ErrUnsafeMutation, deleteRange.StartRowIndex, deleteRange.EndRowIndex)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: not a request that changes objects", ErrUnsafeMutation)
+}
+
+/*
+Lets only one request at a time find objects' rows in a spreadsheet and then change or delete them by row index. A
+delete moves every row below it up, so a request that found its rows before another request's delete went through would
+otherwise change or delete whichever rows moved into their place. Appends don't need it, since they only ever add rows
+below the last one. Rows moved by someone editing the sheet in Google Sheets are still caught by reading the row first.
+*/
+type spreadsheetLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+var rowIndexLocks = &spreadsheetLocks{locks: make(map[string]*sync.Mutex)}
+
+// Waits for the spreadsheet's lock and returns the function that releases it
+func (locks *spreadsheetLocks) lock(spreadsheetId string) func() {
+	locks.mu.Lock()
+	lock, ok := locks.locks[spreadsheetId]
+	if !ok {
+		lock = new(sync.Mutex)
+		locks.locks[spreadsheetId] = lock
+	}
+	locks.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Sends a BatchUpdate that changes objects, after checking none of its requests touch the sheet's structure
+func batchUpdateObjects(ctx context.Context, spreadsheetId string, requests []*sheets.Request) error {
+	for _, request := range requests {
+		if err := checkObjectMutation(request); err != nil {
+			return err
+		}
+	}
+
+	_, err := sheetsService.Spreadsheets.BatchUpdate(spreadsheetId,
+		&sheets.BatchUpdateSpreadsheetRequest{
+			IncludeSpreadsheetInResponse: false,
+			Requests:                     requests,
+		},
+	).Context(ctx).Do()
+	return err
+}
+
+// Responds with an error from batchUpdateObjects. A rejected request is our own bug, not the client's or Google's.
+func writeMutationError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if errors.Is(err, ErrUnsafeMutation) {
+		writeError(w, r, http.StatusInternalServerError, "unsafe_mutation", message+": "+err.Error())
+		return
+	}
+	writeGoogleError(w, r, err, message)
+}
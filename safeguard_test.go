@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+func TestCheckObjectMutation(t *testing.T) {
+	deleteRows := func(startRowIndex int64, endRowIndex int64) *sheets.Request {
+		return &sheets.Request{DeleteRange: &sheets.DeleteRangeRequest{
+			Range:          &sheets.GridRange{StartRowIndex: startRowIndex, EndRowIndex: endRowIndex},
+			ShiftDimension: "ROWS",
+		}}
+	}
+	updateCellsAt := func(rowIndex int64, columnIndex int64) *sheets.Request {
+		return &sheets.Request{UpdateCells: &sheets.UpdateCellsRequest{
+			Start: &sheets.GridCoordinate{RowIndex: rowIndex, ColumnIndex: columnIndex},
+		}}
+	}
+	updateCellsRange := func(startRowIndex int64, startColumnIndex int64) *sheets.Request {
+		return &sheets.Request{UpdateCells: &sheets.UpdateCellsRequest{
+			Range: &sheets.GridRange{StartRowIndex: startRowIndex, EndRowIndex: startRowIndex + 1, StartColumnIndex: startColumnIndex, EndColumnIndex: startColumnIndex + 1},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		request *sheets.Request
+		allowed bool
+	}{
+		{"append", &sheets.Request{AppendCells: &sheets.AppendCellsRequest{}}, true},
+
+		{"update a value cell", updateCellsAt(3, FIRST_VALUE_COLUMN_INDEX), true},
+		{"update the header row", updateCellsAt(0, FIRST_VALUE_COLUMN_INDEX), false},
+		{"update the id column", updateCellsAt(3, 0), false},
+		{"update the datetime column", updateCellsAt(3, DATETIME_COLUMN_INDEX), false},
+		{"update a value cell range", updateCellsRange(3, FIRST_VALUE_COLUMN_INDEX), true},
+		{"update a range in the header row", updateCellsRange(0, FIRST_VALUE_COLUMN_INDEX), false},
+		{"update a range in the id column", updateCellsRange(3, 0), false},
+		{"update a range in the datetime column", updateCellsRange(3, DATETIME_COLUMN_INDEX), false},
+		{"update without a start or range", &sheets.Request{UpdateCells: &sheets.UpdateCellsRequest{}}, false},
+
+		{"delete an object row", deleteRows(1, 2), true},
+		{"delete several object rows", deleteRows(4, 9), true},
+		{"delete the header row", deleteRows(0, 1), false},
+		{"delete from the header row down", deleteRows(0, 5), false},
+		{"delete no rows", deleteRows(3, 3), false},
+		{"delete without a range", &sheets.Request{DeleteRange: &sheets.DeleteRangeRequest{ShiftDimension: "ROWS"}}, false},
+		{
+			name: "delete part of a row",
+			request: &sheets.Request{DeleteRange: &sheets.DeleteRangeRequest{
+				Range:          &sheets.GridRange{StartRowIndex: 2, EndRowIndex: 3, StartColumnIndex: FIRST_VALUE_COLUMN_INDEX, EndColumnIndex: 4},
+				ShiftDimension: "ROWS",
+			}},
+			allowed: false,
+		},
+		{
+			name: "delete the id and datetime columns of a row",
+			request: &sheets.Request{DeleteRange: &sheets.DeleteRangeRequest{
+				Range:          &sheets.GridRange{StartRowIndex: 2, EndRowIndex: 3, EndColumnIndex: FIRST_VALUE_COLUMN_INDEX},
+				ShiftDimension: "ROWS",
+			}},
+			allowed: false,
+		},
+		{
+			name: "delete rows shifting columns",
+			request: &sheets.Request{DeleteRange: &sheets.DeleteRangeRequest{
+				Range:          &sheets.GridRange{StartRowIndex: 2, EndRowIndex: 3},
+				ShiftDimension: "COLUMNS",
+			}},
+			allowed: false,
+		},
+
+		{"delete a sheet", &sheets.Request{DeleteSheet: &sheets.DeleteSheetRequest{SheetId: 1}}, false},
+		{"empty request", &sheets.Request{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkObjectMutation(test.request)
+			if test.allowed && err != nil {
+				t.Errorf("checkObjectMutation refused it: %v", err)
+			}
+			if !test.allowed && !errors.Is(err, ErrUnsafeMutation) {
+				t.Errorf("checkObjectMutation error = %v, want ErrUnsafeMutation", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// The schema is stored as developer metadata on the header row under this key
+const SCHEMA_METADATA_KEY = "columnSchema"
+
+var COLUMN_TYPES []string = []string{"any", "string", "number", "boolean", "date", "datetime"}
+
+/*
+Describes one column of a sheet. An empty Type is the same as "any", which accepts anything newCellData does.
+Default is used when an object leaves the column out (or sends null or ""), and Enum limits the column to a set of values.
+*/
+type ColumnSchema struct {
+	Name     string
+	Type     string
+	Required bool
+	Default  any
+	Enum     []any
+}
+
+type SheetSchema []ColumnSchema
+
+type FieldError struct {
+	Field string
+	Error string
+}
+
+// Checks that a schema from a createSheet request makes sense before it gets saved with the sheet
+func (schema SheetSchema) validate() error {
+	var columnNames []string
+	for _, column := range schema {
+		if column.Name == "" {
+			return errors.New("every column in the schema needs a Name")
+		}
+		if column.Name == "id" || column.Name == "datetime" {
+			return errors.New("column " + column.Name + " is added automatically and can't be in the schema")
+		}
+		if slices.Contains(columnNames, column.Name) {
+			return errors.New("column " + column.Name + " is in the schema more than once")
+		}
+		columnNames = append(columnNames, column.Name)
+
+		if !slices.Contains(COLUMN_TYPES, column.columnType()) {
+			return fmt.Errorf("column %s has unknown type %s, must be one of %v", column.Name, column.Type, COLUMN_TYPES)
+		}
+		for _, enumValue := range column.Enum {
+			if problem := column.checkType(enumValue); problem != "" {
+				return fmt.Errorf("column %s has an enum value that %s", column.Name, problem)
+			}
+		}
+		if !isBlankValue(column.Default) {
+			if problem := column.checkValue(column.Default); problem != "" {
+				return fmt.Errorf("column %s has a default that %s", column.Name, problem)
+			}
+		}
+	}
+	return nil
+}
+
+func (schema SheetSchema) columnNames() []string {
+	var columnNames []string
+	for _, column := range schema {
+		columnNames = append(columnNames, column.Name)
+	}
+	return columnNames
+}
+
+func (schema SheetSchema) getColumn(columnName string) *ColumnSchema {
+	for index := range schema {
+		if schema[index].Name == columnName {
+			return &schema[index]
+		}
+	}
+	return nil
+}
+
+/*
+Applies the schema to a new object's values, which are in column order after id and datetime. Missing values get their
+column's default, and every value that breaks the schema is returned as a FieldError.
+*/
+func (schema SheetSchema) applyToNewObject(columnHeaders []string, rowValues []any) ([]any, []FieldError) {
+	var fieldErrors []FieldError
+	for valueIndex := len(rowValues); valueIndex < len(columnHeaders)-2; valueIndex++ {
+		rowValues = append(rowValues, nil)
+	}
+
+	for valueIndex, value := range rowValues {
+		if valueIndex+2 >= len(columnHeaders) {
+			break
+		}
+		column := schema.getColumn(columnHeaders[valueIndex+2])
+		if column == nil {
+			continue
+		}
+
+		if isBlankValue(value) {
+			if !isBlankValue(column.Default) {
+				rowValues[valueIndex] = column.Default
+				continue
+			}
+			if column.Required {
+				fieldErrors = append(fieldErrors, FieldError{Field: column.Name, Error: "is required"})
+			}
+			continue
+		}
+
+		if problem := column.checkValue(value); problem != "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: column.Name, Error: problem})
+		}
+	}
+	return rowValues, fieldErrors
+}
+
+// Same as applyToNewObject, but for updateObject, where only the supplied fields are checked and no defaults are used
+func (schema SheetSchema) checkUpdatedFields(updatedFields map[string]any) []FieldError {
+	var fieldErrors []FieldError
+	for _, column := range schema {
+		value, ok := updatedFields[column.Name]
+		if !ok {
+			continue
+		}
+
+		if isBlankValue(value) {
+			if column.Required {
+				fieldErrors = append(fieldErrors, FieldError{Field: column.Name, Error: "is required and can't be cleared"})
+			}
+			continue
+		}
+
+		if problem := column.checkValue(value); problem != "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: column.Name, Error: problem})
+		}
+	}
+	return fieldErrors
+}
+
+func (column *ColumnSchema) columnType() string {
+	if column.Type == "" {
+		return "any"
+	}
+	return column.Type
+}
+
+// Returns a description of what's wrong with the value, or "" if it fits the column
+func (column *ColumnSchema) checkValue(value any) string {
+	if problem := column.checkType(value); problem != "" {
+		return problem
+	}
+
+	if len(column.Enum) > 0 && !slices.ContainsFunc(column.Enum, func(enumValue any) bool {
+		return jsonValuesEqual(enumValue, value)
+	}) {
+		return fmt.Sprintf("must be one of %v", column.Enum)
+	}
+	return ""
+}
+
+func (column *ColumnSchema) checkType(value any) string {
+	switch column.columnType() {
+	case "string":
+		if _, ok := value.(string); !ok {
+			return "must be a string"
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			return "must be a number"
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return "must be a boolean"
+		}
+	case "date":
+		stringValue, ok := value.(string)
+		if _, err := time.Parse(time.DateOnly, stringValue); !ok || err != nil {
+			return "must be a date formatted as YYYY-MM-DD"
+		}
+	case "datetime":
+		stringValue, ok := value.(string)
+		if _, isDatetime := parseDatetime(stringValue); !ok || !isDatetime {
+			return "must be an RFC3339 datetime, with or without the offset"
+		}
+	}
+	return ""
+}
+
+/*
+Same as newCellData, except that string columns are always written as text, so a string column holding something like
+"2024-01-01" or "=x" isn't turned into a date or a formula.
+*/
+func newCellDataForColumn(value any, column *ColumnSchema) (*sheets.CellData, error) {
+	if stringValue, ok := value.(string); ok && column != nil && column.columnType() == "string" {
+		return newStringCellData(stringValue), nil
+	}
+	return newCellData(value)
+}
+
+func newSchemaMetadataRequest(schema SheetSchema, sheetId int64) (*sheets.Request, error) {
+	schemaBytes, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sheets.Request{
+		CreateDeveloperMetadata: &sheets.CreateDeveloperMetadataRequest{
+			DeveloperMetadata: &sheets.DeveloperMetadata{
+				MetadataKey:   SCHEMA_METADATA_KEY,
+				MetadataValue: string(schemaBytes),
+				Visibility:    "DOCUMENT",
+				Location: &sheets.DeveloperMetadataLocation{
+					DimensionRange: &sheets.DimensionRange{
+						SheetId:    sheetId,
+						Dimension:  "ROWS",
+						StartIndex: 0,
+						EndIndex:   1,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+/*
+Reads the schema saved on a sheet's header row. The sheet has to have been fetched with grid data. Sheets made without
+a schema return nil.
+*/
+func getSheetSchema(sheet *sheets.Sheet) (SheetSchema, error) {
+	if len(sheet.Data) == 0 || len(sheet.Data[0].RowMetadata) == 0 {
+		return nil, nil
+	}
+
+	for _, metadata := range sheet.Data[0].RowMetadata[0].DeveloperMetadata {
+		if metadata.MetadataKey != SCHEMA_METADATA_KEY {
+			continue
+		}
+		return decodeSheetSchema(metadata.MetadataValue)
+	}
+	return nil, nil
+}
+
+func decodeSheetSchema(encodedSchema string) (SheetSchema, error) {
+	var schema SheetSchema
+	decoder := json.NewDecoder(strings.NewReader(encodedSchema))
+	decoder.UseNumber()
+	err := decoder.Decode(&schema)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode sheet schema. Error: %v", err)
+	}
+	return schema, nil
+}
+
+func isBlankValue(value any) bool {
+	return value == nil || value == ""
+}
+
+func jsonValuesEqual(a any, b any) bool {
+	aBytes, aErr := json.Marshal(a)
+	bBytes, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aBytes, bBytes)
+}
+
+// Responds 422 with every field that broke the sheet's schema
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, fieldErrors []FieldError) {
+	writeErrorDetails(w, r, http.StatusUnprocessableEntity, ErrorDetails{
+		Code:        "schema_violation",
+		Message:     "The object doesn't match the sheet's schema",
+		FieldErrors: fieldErrors,
+	})
+}
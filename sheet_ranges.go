@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+var ErrSheetNotFound = errors.New("no sheet with that title was found")
+
+// The sheet's rows kept moving while a page was being read, so there's no page that can be trusted. Trying again works.
+var ErrSheetChangedDuringRead = errors.New("the sheet changed while it was being read")
+
+/*
+Field masks for reading parts of a sheet. Asking for grid data without a mask (or without ranges) downloads every cell of
+every sheet, with all of its formatting, which takes seconds on a big spreadsheet.
+
+LOOKUP_FIELDS is enough for the column headers, the schema (which lives on the header row's metadata) and the id and
+datetime columns. ROW_FIELDS also has what cellToValue needs to give cells their types.
+*/
+const LOOKUP_FIELDS = "sheets(properties(sheetId,title),data(startRow,rowData.values.formattedValue,rowMetadata.developerMetadata(metadataKey,metadataValue)))"
+const ROW_FIELDS = "sheets(properties(sheetId,title),data(startRow,rowData.values(formattedValue,effectiveValue,effectiveFormat.numberFormat.type)))"
+
+/*
+Builds an A1 range like 'My Sheet'!1:1, or just 'My Sheet' for the whole sheet if a1Range is empty. Sheet titles are
+always quoted, with any quotes in them doubled.
+*/
+func sheetRange(sheetTitle string, a1Range string) string {
+	quotedTitle := "'" + strings.ReplaceAll(sheetTitle, "'", "''") + "'"
+	if a1Range == "" {
+		return quotedTitle
+	}
+	return quotedTitle + "!" + a1Range
+}
+
+// The A1 range for rows startIndex up to (not including) endIndex, where index 0 is the column header row
+func rowsRange(startIndex int, endIndex int) string {
+	return fmt.Sprintf("%d:%d", startIndex+1, endIndex)
+}
+
+/*
+Fetches only the given A1 ranges (e.g. "1:1" or "A:B") of one sheet, with only the fields in the mask. The ranges come
+back as the sheet's Data, in the same order they were asked for. Returns ErrSheetNotFound if the spreadsheet has no
+sheet with the title.
+*/
+func getSheetRanges(ctx context.Context, spreadsheetId string, sheetTitle string, fields googleapi.Field, a1Ranges ...string) (*sheets.Sheet, error) {
+	var ranges []string
+	for _, a1Range := range a1Ranges {
+		ranges = append(ranges, sheetRange(sheetTitle, a1Range))
+	}
+
+	spreadsheet, err := sheetsService.Spreadsheets.Get(spreadsheetId).
+		Ranges(ranges...).
+		IncludeGridData(true).
+		Fields(fields).
+		Context(ctx).
+		Do()
+
+	// Sheets doesn't have a not found error for sheets, a range on a sheet that doesn't exist just can't be parsed
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) && googleErr.Code == http.StatusBadRequest && strings.Contains(googleErr.Message, "Unable to parse range") {
+		return nil, ErrSheetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(spreadsheet.Sheets) == 0 {
+		return nil, ErrSheetNotFound
+	}
+	sheet := spreadsheet.Sheets[0]
+	// Every range should have a GridData, even an empty one, but don't let the callers index past the end if not
+	for len(sheet.Data) < len(a1Ranges) {
+		sheet.Data = append(sheet.Data, &sheets.GridData{})
+	}
+	return sheet, nil
+}
+
+/*
+Fetches the sheet's header row, which has the column headers and the schema, and its id column. Row indexes into the
+id column (sheet.Data[1].RowData) are the same as the sheet's row indexes.
+*/
+func getSheetHeaderAndIds(ctx context.Context, spreadsheetId string, sheetTitle string) (*sheets.Sheet, error) {
+	return getSheetRanges(ctx, spreadsheetId, sheetTitle, LOOKUP_FIELDS, "1:1", "A:A")
+}
+
+// Fetches a single row with its typed values, or nil if the row is empty or past the end of the sheet
+func getSheetRow(ctx context.Context, spreadsheetId string, sheetTitle string, rowIndex int64) (*sheets.RowData, error) {
+	sheet, err := getSheetRanges(ctx, spreadsheetId, sheetTitle, ROW_FIELDS, rowsRange(int(rowIndex), int(rowIndex)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(sheet.Data[0].RowData) == 0 {
+		return nil, nil
+	}
+	return sheet.Data[0].RowData[0], nil
+}
+
+/*
+Fetches every row of the sheet with its typed values, as the sheet's Data[0]. Row indexes into it are the same as the
+sheet's row indexes, so the column header row is row 0.
+*/
+func getSheetWithRows(ctx context.Context, spreadsheetId string, sheetTitle string) (*sheets.Sheet, error) {
+	return getSheetRanges(ctx, spreadsheetId, sheetTitle, ROW_FIELDS, "")
+}
+
+func writeSheetReadError(w http.ResponseWriter, r *http.Request, spreadsheetTitle string, sheetTitle string, err error) {
+	if errors.Is(err, ErrSheetNotFound) {
+		writeError(w, r, http.StatusNotFound, "sheet_not_found", "Unable to find requested sheet "+sheetTitle+" in "+spreadsheetTitle)
+		return
+	}
+	if errors.Is(err, ErrInvalidFilter) {
+		writeError(w, r, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	if errors.Is(err, ErrInvalidSort) {
+		writeError(w, r, http.StatusBadRequest, "invalid_sort", err.Error())
+		return
+	}
+	if errors.Is(err, ErrSheetChangedDuringRead) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, "sheet_changed", "Sheet "+sheetTitle+" in "+spreadsheetTitle+" changed while it was being read, try again")
+		return
+	}
+	writeGoogleError(w, r, err, "Unable to read sheet "+sheetTitle+" from sheets service")
+}
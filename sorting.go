@@ -0,0 +1,227 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+var ErrInvalidSort = errors.New("invalid sort")
+
+// One column from readSheetData's sort parameter, which is a list of column headers each optionally prefixed with -
+type sortKey struct {
+	column     string
+	descending bool
+}
+
+// Parses a sort parameter like "name,-age" for a sheet with the given column headers
+func parseSortKeys(sortParam string, columnHeaders []string) ([]sortKey, error) {
+	var sortKeys []sortKey
+	for _, column := range strings.Split(sortParam, ",") {
+		column = strings.TrimSpace(column)
+		key := sortKey{column: strings.TrimPrefix(column, "-"), descending: strings.HasPrefix(column, "-")}
+		if key.column == "" {
+			return nil, errors.New("sort has an empty column")
+		}
+		if !slices.Contains(columnHeaders, key.column) {
+			return nil, fmt.Errorf("sort has %q, which isn't a column header of this sheet", key.column)
+		}
+		sortKeys = append(sortKeys, key)
+	}
+	return sortKeys, nil
+}
+
+func sortValues(object map[string]any, sortKeys []sortKey) []any {
+	var values []any
+	for _, key := range sortKeys {
+		values = append(values, object[key.column])
+	}
+	return values
+}
+
+/*
+Orders two sets of sort values column by column. Numbers come before text and text before booleans, and blank cells
+always come last, whichever way the column is sorted.
+*/
+func compareSortValues(left []any, right []any, sortKeys []sortKey) int {
+	for index, key := range sortKeys {
+		if index >= len(left) || index >= len(right) {
+			return cmp.Compare(len(left), len(right))
+		}
+		leftRank, rightRank := sortValueRank(left[index]), sortValueRank(right[index])
+		if leftRank != rightRank {
+			if key.descending && leftRank != BLANK_SORT_RANK && rightRank != BLANK_SORT_RANK {
+				return cmp.Compare(rightRank, leftRank)
+			}
+			return cmp.Compare(leftRank, rightRank)
+		}
+		if leftRank == BLANK_SORT_RANK {
+			continue
+		}
+
+		order := 0
+		switch leftValue := left[index].(type) {
+		case float64:
+			order = cmp.Compare(leftValue, right[index].(float64))
+		case string:
+			order = strings.Compare(leftValue, right[index].(string))
+		case bool:
+			order = cmp.Compare(sortBoolRank(leftValue), sortBoolRank(right[index].(bool)))
+		}
+		if key.descending {
+			order = -order
+		}
+		if order != 0 {
+			return order
+		}
+	}
+	return 0
+}
+
+const BLANK_SORT_RANK = 3
+
+func sortValueRank(value any) int {
+	switch typedValue := value.(type) {
+	case float64:
+		return 0
+	case string:
+		if typedValue == "" {
+			return BLANK_SORT_RANK
+		}
+		return 1
+	case bool:
+		return 2
+	}
+	return BLANK_SORT_RANK
+}
+
+func sortBoolRank(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+/*
+Reads a page of the sheet sorted by the sort parameter. Sorting needs every row, so the whole sheet is read for each
+page. Rows that sort the same stay in sheet row order. The cursor holds the last row's sort values as well as its ID, so
+that if that row gets deleted the next page starts at the first row that sorts after it.
+Blank rows aren't objects and are left out.
+*/
+func readSortedPageFromSheet(ctx context.Context, numRows int, cursor *sheetCursor, filterQuery string, sortParam string, spreadsheetId string, sheetTitle string) ([]string, []sheetPageRow, string, error) {
+	sheet, err := getSheetWithRows(ctx, spreadsheetId, sheetTitle)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	rows := sheet.Data[0].RowData
+	columnHeaders := getColumnHeaders(&sheets.Sheet{Data: sheet.Data[:1]})
+
+	sortKeys, err := parseSortKeys(sortParam, columnHeaders)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("%w: %v", ErrInvalidSort, err)
+	}
+	var filter filterExpression
+	if filterQuery != "" {
+		filter, err = parseFilter(filterQuery, columnHeaders)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+		}
+	}
+
+	var sortedRows []sheetPageRow
+	for index := 1; index < len(rows); index++ {
+		if cellFormattedValue(rows[index], 0) == "" {
+			continue
+		}
+		object := rowToObject(columnHeaders, rows[index])
+		if filter != nil && !filter.matches(object) {
+			continue
+		}
+		sortedRows = append(sortedRows, sheetPageRow{rowIndex: index, object: object, row: rows[index]})
+	}
+	slices.SortStableFunc(sortedRows, func(left sheetPageRow, right sheetPageRow) int {
+		return compareSortValues(sortValues(left.object, sortKeys), sortValues(right.object, sortKeys), sortKeys)
+	})
+
+	startIndex := 0
+	if cursor != nil {
+		startIndex = findSortedCursorStartIndex(sortedRows, cursor, sortKeys)
+	}
+	endIndex := min(startIndex+numRows, len(sortedRows))
+	if startIndex >= endIndex {
+		return columnHeaders, nil, "", nil
+	}
+
+	var nextCursor string
+	if endIndex < len(sortedRows) {
+		lastRow := sortedRows[endIndex-1]
+		nextPageCursor := cursorForRow(lastRow.row)
+		nextPageCursor.Sort = sortParam
+		nextPageCursor.SortValues = sortValues(lastRow.object, sortKeys)
+		nextCursor = encodeCursor(nextPageCursor)
+	}
+	return columnHeaders, sortedRows[startIndex:endIndex], nextCursor, nil
+}
+
+// The sorted version of findCursorRowIndex, returning the index into sortedRows of the first row after the cursor
+func findSortedCursorStartIndex(sortedRows []sheetPageRow, cursor *sheetCursor, sortKeys []sortKey) int {
+	for index, sortedRow := range sortedRows {
+		if cellFormattedValue(sortedRow.row, 0) == cursor.ObjectId {
+			return index + 1
+		}
+	}
+
+	// The cursor's row is gone, so start at the first row that sorts after it. Rows that sort the same are in row
+	// order, which is datetime order, so of those the ones created at or after it come next.
+	cursorTime, hasTime := parseRowDatetime(cursor.Datetime)
+	for index, sortedRow := range sortedRows {
+		order := compareSortValues(sortValues(sortedRow.object, sortKeys), cursor.SortValues, sortKeys)
+		if order > 0 {
+			return index
+		}
+		if order == 0 && hasTime {
+			rowTime, ok := parseRowDatetime(cellFormattedValue(sortedRow.row, DATETIME_COLUMN_INDEX))
+			if ok && !rowTime.Before(cursorTime) {
+				return index
+			}
+		}
+	}
+	return len(sortedRows)
+}
+
+/*
+Parses readSheetData's fields parameter, a list of the column headers to return. The id column is always returned, so
+that every row can be read back or updated by its ID.
+*/
+func parseFields(fieldsParam string, columnHeaders []string) ([]string, error) {
+	var fields []string
+	if len(columnHeaders) > 0 {
+		fields = append(fields, columnHeaders[0])
+	}
+	for _, field := range strings.Split(fieldsParam, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			return nil, errors.New("fields has an empty column")
+		}
+		if !slices.Contains(columnHeaders, field) {
+			return nil, fmt.Errorf("fields has %q, which isn't a column header of this sheet", field)
+		}
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+func projectObject(object map[string]any, fields []string) map[string]any {
+	var projected map[string]any = make(map[string]any)
+	for _, field := range fields {
+		projected[field] = object[field]
+	}
+	return projected
+}
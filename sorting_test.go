@@ -0,0 +1,153 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+func TestCompareSortValues(t *testing.T) {
+	ascending := []sortKey{{column: "a"}}
+	descending := []sortKey{{column: "a", descending: true}}
+
+	tests := []struct {
+		name     string
+		left     any
+		right    any
+		sortKeys []sortKey
+		want     int
+	}{
+		{"numbers", 1.0, 2.0, ascending, -1},
+		{"numbers descending", 1.0, 2.0, descending, 1},
+		{"equal numbers", 2.0, 2.0, descending, 0},
+		{"text", "apple", "banana", ascending, -1},
+		{"text descending", "apple", "banana", descending, 1},
+		{"false before true", false, true, ascending, -1},
+		{"true before false descending", false, true, descending, 1},
+		{"numbers before text", 9.0, "a", ascending, -1},
+		{"text before numbers descending", 9.0, "a", descending, 1},
+		{"text before booleans", "z", false, ascending, -1},
+		{"booleans before text descending", "z", false, descending, 1},
+		{"blank last", "", 1.0, ascending, 1},
+		{"blank last descending", "", 1.0, descending, 1},
+		{"nil is blank", nil, "a", ascending, 1},
+		{"nil is blank descending", "a", nil, descending, -1},
+		{"blanks are equal", "", nil, descending, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := compareSortValues([]any{test.left}, []any{test.right}, test.sortKeys)
+			if got != test.want {
+				t.Errorf("compareSortValues(%#v, %#v) = %d, want %d", test.left, test.right, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompareSortValuesSortsRows(t *testing.T) {
+	sortKeys := []sortKey{{column: "group"}, {column: "score", descending: true}}
+	values := [][]any{
+		{"b", 1.0},
+		{"", 5.0},
+		{"a", ""},
+		{"a", 3.0},
+		{"b", 7.0},
+		{"a", 10.0},
+	}
+	want := [][]any{
+		{"a", 10.0},
+		{"a", 3.0},
+		{"a", ""},
+		{"b", 7.0},
+		{"b", 1.0},
+		{"", 5.0},
+	}
+
+	slices.SortStableFunc(values, func(left []any, right []any) int {
+		return compareSortValues(left, right, sortKeys)
+	})
+	for index := range want {
+		if !slices.Equal(values[index], want[index]) {
+			t.Fatalf("sorted = %v, want %v", values, want)
+		}
+	}
+}
+
+func TestFindSortedCursorStartIndex(t *testing.T) {
+	sortKeys := []sortKey{{column: "score", descending: true}}
+	newRow := func(objectId string, datetime string, score any) sheetPageRow {
+		return sheetPageRow{
+			object: map[string]any{"id": objectId, "score": score},
+			row: &sheets.RowData{Values: []*sheets.CellData{
+				{FormattedValue: objectId},
+				{FormattedValue: datetime},
+			}},
+		}
+	}
+	// Already sorted by score descending, ties in datetime order
+	sortedRows := []sheetPageRow{
+		newRow("a", "2024-01-01T10:00:00Z UTC", 9.0),
+		newRow("b", "2024-01-01T09:00:00Z UTC", 5.0),
+		newRow("c", "2024-01-01T11:00:00Z UTC", 5.0),
+		newRow("d", "2024-01-01T12:00:00Z UTC", 1.0),
+		newRow("e", "2024-01-01T08:00:00Z UTC", ""),
+	}
+
+	tests := []struct {
+		name   string
+		cursor sheetCursor
+		want   int
+	}{
+		{
+			name:   "cursor row is still there",
+			cursor: sheetCursor{ObjectId: "b", Datetime: "2024-01-01T09:00:00Z UTC", SortValues: []any{5.0}},
+			want:   2,
+		},
+		{
+			name:   "cursor row is the last row",
+			cursor: sheetCursor{ObjectId: "e", Datetime: "2024-01-01T08:00:00Z UTC", SortValues: []any{""}},
+			want:   5,
+		},
+		{
+			name:   "deleted cursor row sorted between others",
+			cursor: sheetCursor{ObjectId: "gone", Datetime: "2024-01-01T07:00:00Z UTC", SortValues: []any{7.0}},
+			want:   1,
+		},
+		{
+			name:   "deleted cursor row tied with rows created before and after it",
+			cursor: sheetCursor{ObjectId: "gone", Datetime: "2024-01-01T10:00:00Z UTC", SortValues: []any{5.0}},
+			want:   2,
+		},
+		{
+			name:   "deleted cursor row tied with rows all created after it",
+			cursor: sheetCursor{ObjectId: "gone", Datetime: "2024-01-01T08:30:00Z UTC", SortValues: []any{5.0}},
+			want:   1,
+		},
+		{
+			name:   "deleted cursor row tied with rows all created before it",
+			cursor: sheetCursor{ObjectId: "gone", Datetime: "2024-01-01T11:30:00Z UTC", SortValues: []any{5.0}},
+			want:   3,
+		},
+		{
+			name:   "deleted cursor row with a blank value",
+			cursor: sheetCursor{ObjectId: "gone", Datetime: "2024-01-01T09:00:00Z UTC", SortValues: []any{""}},
+			want:   5,
+		},
+		{
+			name:   "deleted cursor row without a datetime",
+			cursor: sheetCursor{ObjectId: "gone", SortValues: []any{5.0}},
+			want:   3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := findSortedCursorStartIndex(sortedRows, &test.cursor, sortKeys)
+			if got != test.want {
+				t.Errorf("findSortedCursorStartIndex = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+/*
+Wraps the token source behind the Sheets and Drive clients. It keeps track of whether Google is still accepting our
+credentials, and for the user OAuth mode it writes refreshed tokens back to token.json so that a restart doesn't start
+over from a stale access token.
+*/
+type trackingTokenSource struct {
+	source oauth2.TokenSource
+	// Where refreshed tokens are saved, empty for service accounts and ADC which manage their own tokens
+	tokenFile string
+
+	mu              sync.Mutex
+	lastAccessToken string
+}
+
+func newTrackingTokenSource(source oauth2.TokenSource, tokenFile string, initialToken *oauth2.Token) *trackingTokenSource {
+	tokenSource := &trackingTokenSource{source: source, tokenFile: tokenFile}
+	if initialToken != nil {
+		tokenSource.lastAccessToken = initialToken.AccessToken
+	}
+	return tokenSource
+}
+
+func (tokenSource *trackingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := tokenSource.source.Token()
+	if err != nil {
+		if isReauthenticationRequired(err) {
+			googleAuthStatus.setReauthenticationRequired(err)
+		}
+		return nil, err
+	}
+	googleAuthStatus.setOK()
+
+	tokenSource.mu.Lock()
+	defer tokenSource.mu.Unlock()
+
+	if tokenSource.tokenFile != "" && tok.AccessToken != tokenSource.lastAccessToken {
+		err = writeTokenFile(tokenSource.tokenFile, tok)
+		if err != nil {
+			// The new token still works for this run, it just won't survive a restart
+			log.Printf("Unable to save refreshed token to %s: %v", tokenSource.tokenFile, err)
+		} else {
+			tokenSource.lastAccessToken = tok.AccessToken
+		}
+	}
+	return tok, nil
+}
+
+/*
+An invalid_grant from the token endpoint means the refresh token (or service account key) was revoked or expired, so
+every call will keep failing until someone signs in again.
+*/
+func isReauthenticationRequired(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant"
+}
+
+type authStatus struct {
+	mu                     sync.Mutex
+	reauthenticationNeeded bool
+	lastError              string
+	since                  time.Time
+}
+
+var googleAuthStatus authStatus
+
+func (status *authStatus) setReauthenticationRequired(err error) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+
+	if !status.reauthenticationNeeded {
+		log.Printf("Google rejected our credentials, re-authentication is required: %v", err)
+		status.since = time.Now()
+	}
+	status.reauthenticationNeeded = true
+	status.lastError = err.Error()
+}
+
+func (status *authStatus) setOK() {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+
+	status.reauthenticationNeeded = false
+	status.lastError = ""
+	status.since = time.Time{}
+}
+
+// Returns whether re-authentication is required, and if so the error Google gave and when it started
+func (status *authStatus) get() (bool, string, time.Time) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+
+	return status.reauthenticationNeeded, status.lastError, status.since
+}